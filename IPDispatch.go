@@ -1,10 +1,12 @@
 package main
 
 import (
+	"crypto/subtle"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
 	"runtime"
 	"strconv"
@@ -29,6 +31,7 @@ var ipdResultCH = make(chan ipdAction, 1)
 var ipdCH = make(chan *ipzone.IPDisp, 1)
 
 var actionLock sync.Mutex
+var adm *admission
 
 const (
 	//Version 版本号
@@ -38,11 +41,23 @@ const (
 )
 
 var (
-	conf     = flag.String("c", "no", "configure dir")
-	pidfile  = flag.String("p", "/tmp/IPDispatch.pid", "the pidfile's path")
-	username = flag.String("u", "root", "assume identity of <username>")
-	ncpu     = flag.Int("n", 0, "number cpus")
-	lport    = flag.String("l", ":8080", "Listen addr")
+	conf      = flag.String("c", "no", "configure dir")
+	pidfile   = flag.String("p", "/tmp/IPDispatch.pid", "the pidfile's path")
+	username  = flag.String("u", "root", "assume identity of <username>")
+	ncpu      = flag.Int("n", 0, "number cpus")
+	lport     = flag.String("l", ":8080", "Listen addr")
+	maxconc   = flag.Int("maxconc", 0, "max concurrent dispatch requests, 0 is unlimited")
+	maxqps    = flag.Int("maxqps", 0, "max dispatch requests per second, 0 is unlimited")
+	report    = flag.Bool("report", false, "print the fallback order of each zone and exit")
+	trustpx   = flag.String("trustproxy", "", "trusted proxy CIDRs whose X-Forwarded-Proto is used, separated by commas")
+	dnsaddr   = flag.String("dns", "", "DNS listen addr (udp and tcp), empty is disabled")
+	pxtimeout = flag.Duration("proxytimeout", 30*time.Second, "timeout waiting for the response header in proxy mode")
+	tlsaddr   = flag.String("tls", "", "HTTPS listen addr, certificates are cert.pem and key.pem in each host dir, empty is disabled")
+	tracekey  = flag.String("tracekey", "", "requests with header X-IPD-Trace equal to this key get the dispatch trace instead of a redirect, empty is disabled")
+	failact   = flag.String("fail", "", "response on dispatch failure: redirect, or a status code such as 404 or 503; empty is 404 for unknown hosts and 503 otherwise")
+	failurl   = flag.String("failurl", "", "redirect URL template on dispatch failure, used with -fail redirect")
+	failbody  = flag.String("failbody", "", "response body template on dispatch failure")
+	failretry = flag.Int("failretry", 0, "Retry-After seconds on dispatch failure, 0 is not set")
 )
 
 func main() {
@@ -56,6 +71,23 @@ func main() {
 		fmt.Printf("No configure dir")
 		os.Exit(1)
 	}
+	if err = parseTrustProxy(*trustpx); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if err = initFailure(); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if *report {
+		ipdispIns, err := loadDisp(*conf)
+		if err != nil {
+			fmt.Printf("Init false: %v\n", err)
+			os.Exit(1)
+		}
+		ipdispIns.Report(os.Stdout)
+		os.Exit(0)
+	}
 	var nullFile *os.File
 	var userinfo *user.User
 	var credential *syscall.Credential
@@ -86,40 +118,17 @@ func main() {
 		os.Exit(1)
 	}
 	go func(ipdispch chan *ipzone.IPDisp, action chan ipdAction, result chan ipdAction) {
-		var ipdispIns = ipzone.New()
-		err = ipdispIns.Init(*conf)
+		ipdispIns, err := loadDisp(*conf)
 		if err != nil {
 			fmt.Printf("Init false: %v\n", err)
 			os.Remove(*pidfile)
 			os.Exit(1)
 		}
-		ipdispch <- ipdispIns
-		for {
-			select {
-			case doAction := <-action:
-				switch {
-				case doAction.action == "get":
-					pm := doAction.param
-					doAction.result = ipdispIns.GetCount(pm["host"], pm["node"], pm["last"])
-				case doAction.action == "query":
-					pm := doAction.param
-					ip, zone, _ := ipdispIns.Query(pm["clip"], pm["host"], pm["path"])
-					toip := make(map[string]string)
-					toip["ip"] = ip
-					toip["zonename"] = zone
-					doAction.result = toip
-				case doAction.action == "set":
-					pm := doAction.param
-					vv := doAction.result.([]string)
-					err := ipdispIns.Set(pm["host"], pm["object"], vv)
-					doAction.result = false
-					if err == nil {
-						doAction.result = true
-					}
-				}
-				result <- doAction
-			}
+		if err := ipdispIns.SaveNewZone(*conf); err != nil {
+			fmt.Fprintf(os.Stderr, "Save zoneid false: %v\n", err)
 		}
+		ipdispch <- ipdispIns
+		actions(ipdispIns, action, result)
 	}(ipdCH, ipdActionCH, ipdResultCH)
 	select {
 	case ipdisp = <-ipdCH:
@@ -127,24 +136,176 @@ func main() {
 	case <-time.After(time.Duration(3) * time.Second):
 		fmt.Printf("Init false.\n")
 	}
-	gracehttp.Serve(&http.Server{Addr: *lport,
+	adm = newAdmission(*maxconc, *maxqps)
+	initProxy(*pxtimeout)
+	if *dnsaddr != "" {
+		serveDNS(*dnsaddr)
+	}
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			reload()
+		}
+	}()
+	servers := []*http.Server{{Addr: *lport,
 		Handler:        ipDisp(),
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 2048})
+		MaxHeaderBytes: 2048}}
+	if *tlsaddr != "" {
+		if err = certs.load(*conf, ipdisp); err != nil {
+			fmt.Fprintf(os.Stderr, "Load certificates false: %v\n", err)
+		}
+		servers = append(servers, &http.Server{Addr: *tlsaddr,
+			Handler:        servers[0].Handler,
+			TLSConfig:      tlsConfig(),
+			ReadTimeout:    10 * time.Second,
+			WriteTimeout:   10 * time.Second,
+			MaxHeaderBytes: 2048})
+	}
+	gracehttp.Serve(servers...)
 
 }
 
+//actions 调度协程：依次处理ipdActionCH中的请求，结果写入ipdResultCH
+func actions(ipdispIns *ipzone.IPDisp, action chan ipdAction, result chan ipdAction) {
+	for {
+		select {
+		case doAction := <-action:
+			switch {
+			case doAction.action == "get":
+				pm := doAction.param
+				doAction.result = ipdispIns.GetCount(pm["host"], pm["node"], pm["last"], pm["item"])
+			case doAction.action == "query":
+				pm := doAction.param
+				rsv := &resolution{}
+				rsv.res, rsv.err = ipdispIns.Query(pm["clip"], pm["host"], pm["path"])
+				if rsv.err != nil {
+					rsv.failure = ipdispIns.Failure(pm["host"])
+				}
+				//代理方式下，连接失败时依次重试备选服务器
+				if rsv.err == nil && rsv.res.Mode() == "proxy" {
+					rsv.alts = rsv.res.Alternates(proxyRetry)
+				}
+				doAction.result = rsv
+			case doAction.action == "resolve":
+				pm := doAction.param
+				rsv := &resolution{}
+				var res *ipzone.Result
+				if res, rsv.err = ipdispIns.Query(pm["clip"], pm["host"], pm["path"]); rsv.err == nil {
+					n, _ := strconv.Atoi(pm["n"])
+					rsv.res = res
+					rsv.alts = res.Alternates(n)
+				} else {
+					rsv.failure = ipdispIns.Failure(pm["host"])
+				}
+				doAction.result = rsv
+			case doAction.action == "dns":
+				//DNS查询只应答已配置的域名，不使用catchall
+				pm := doAction.param
+				rsv := &resolution{}
+				//Alternates的参数为0时不限制个数，dnsnum为1时不需要备选服务器
+				if rsv.res, rsv.err = ipdispIns.QueryHost(pm["clip"], pm["host"], pm["path"]); rsv.err == nil && rsv.res.DNSNum() > 1 {
+					rsv.alts = rsv.res.Alternates(rsv.res.DNSNum() - 1)
+				}
+				doAction.result = rsv
+			case doAction.action == "explain":
+				pm := doAction.param
+				doAction.result = ipdispIns.Explain(pm["clip"], pm["host"], pm["path"])
+			case doAction.action == "batch":
+				doAction.result = ipdispIns.Batch(doAction.result.([][3]string))
+			case doAction.action == "reload":
+				//重新加载配置，失败时继续使用原配置。通过接口修改的设置和计数在新配置中保留
+				ins, err := loadDisp(*conf)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Reload false: %v\n", err)
+					doAction.result = false
+				} else {
+					ins.Carry(ipdispIns)
+					if err := ins.SaveNewZone(*conf); err != nil {
+						fmt.Fprintf(os.Stderr, "Save zoneid false: %v\n", err)
+					}
+					ipdispIns = ins
+					ipdisp = ins
+					doAction.result = true
+				}
+			case doAction.action == "schedule":
+				pm := doAction.param
+				at := time.Now()
+				if pm["at"] != "" {
+					if sec, err := strconv.ParseInt(pm["at"], 10, 64); err == nil {
+						at = time.Unix(sec, 0)
+					} else if t, err := time.Parse(time.RFC3339, pm["at"]); err == nil {
+						at = t
+					}
+				}
+				name, err := ipdispIns.Schedule(pm["host"], at)
+				if err != nil {
+					name = ""
+				}
+				doAction.result = name
+			case doAction.action == "set":
+				pm := doAction.param
+				vv := doAction.result.([]string)
+				err := ipdispIns.Set(pm["host"], pm["object"], vv)
+				doAction.result = false
+				if err == nil {
+					doAction.result = true
+				}
+			}
+			result <- doAction
+		}
+	}
+}
+
+//explain 模拟调度并返回调度过程，调用前需持有actionLock
+func explain(clip string, host string, path string) *ipzone.Trace {
+	ipdActionCH <- ipdAction{action: "explain", param: map[string]string{"clip": clip, "host": host, "path": path}}
+	ipdaction := <-ipdResultCH
+	return ipdaction.result.(*ipzone.Trace)
+}
+
+//reload 重新加载配置和证书，SIGHUP或/ipdadmin/reload触发
+func reload() bool {
+	actionLock.Lock()
+	defer actionLock.Unlock()
+	ipdActionCH <- ipdAction{action: "reload"}
+	ipdaction := <-ipdResultCH
+	if ipdaction.result.(bool) == false {
+		return false
+	}
+	if *tlsaddr != "" {
+		if err := certs.load(*conf, ipdisp); err != nil {
+			fmt.Fprintf(os.Stderr, "Reload certificates false: %v\n", err)
+			return false
+		}
+	}
+	return true
+}
+
 func ipDisp() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		actionLock.Lock()
-		defer actionLock.Unlock()
 		w.Header().Set("Server", SVer)
-		clip := r.RemoteAddr
-		speAddr := r.Header.Get("X-Addr")
-		if speAddr != "" {
-			clip = speAddr
+		clip := clientIP(r)
+		//超过调度系统的处理能力时，走降级流程，不再排队
+		if adm.acquire() == false {
+			adm.degrade(w, r, clip)
+			return
+		}
+		defer adm.release()
+		actionLock.Lock()
+		locked := true
+		defer func() {
+			if locked {
+				actionLock.Unlock()
+			}
+		}()
+		//带有调试头的请求，返回调度过程而不跳转
+		if *tracekey != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-IPD-Trace")), []byte(*tracekey)) == 1 {
+			writeJSON(w, http.StatusOK, explain(clip, r.Host, r.URL.Path))
+			return
 		}
 		qzone := r.Header.Get("X-Query-Zone")
 		if qzone == "yes" {
@@ -161,17 +322,32 @@ func ipDisp() http.Handler {
 			ipdaction.param = p
 			//ip, _, _ := ipdisp.Query(clip, r.Host, r.URL.Path)
 			ipdActionCH <- ipdaction
-			var ip string
-			//var zonename string
+			var rsv *resolution
 			select {
 			case ipdaction = <-ipdResultCH:
-				result := ipdaction.result.(map[string]string)
-				ip = result["ip"]
+				rsv = ipdaction.result.(*resolution)
+			}
+			//回源获取播放列表或代理时不占用调度协程
+			actionLock.Unlock()
+			locked = false
+			res := rsv.res
+			if res == nil {
+				fail(w, r, clip, rsv)
+				return
+			}
+			adm.remember(r.Host, clip, res)
+			switch {
+			case res.Mode() == "manifest" && isManifest(r.URL.Path):
+				serveManifest(w, r, res)
+			case res.Mode() == "proxy":
+				serveProxy(w, r, clip, rsv)
+			default:
+				w.Header().Set("Location", res.Location(reqScheme(r), r.URL.EscapedPath(), r.URL.RawQuery, clip))
+				w.WriteHeader(res.Status())
 			}
-			w.Header().Set("Location", "http://"+ip+r.URL.Path)
-			w.WriteHeader(http.StatusFound)
 		}
 	})
+	mux.HandleFunc("/ipd/resolve", resolve)
 	mux.HandleFunc("/ipdadmin/set", func(w http.ResponseWriter, r *http.Request) {
 		actionLock.Lock()
 		defer actionLock.Unlock()
@@ -209,12 +385,17 @@ func ipDisp() http.Handler {
 		}
 	})
 	mux.HandleFunc("/ipdadmin/get", func(w http.ResponseWriter, r *http.Request) {
-		actionLock.Lock()
-		defer actionLock.Unlock()
 		w.Header().Set("Server", SVer)
 		queryparam := r.URL.Query()
+		//过载保护的统计信息不经过调度协程
+		if queryparam.Get("node") == "admission" {
+			w.Write([]byte(strconv.FormatUint(adm.count(queryparam.Get("item")), 32)))
+			return
+		}
+		actionLock.Lock()
+		defer actionLock.Unlock()
 		ipdaction := ipdAction{}
-		ipdaction.param = map[string]string{"host": "", "node": "", "last": ""}
+		ipdaction.param = map[string]string{"host": "", "node": "", "last": "", "item": ""}
 		for k := range ipdaction.param {
 			//fmt.Printf("pp: %s %s\n", k, q)
 			v, ok := queryparam[k]
@@ -231,5 +412,49 @@ func ipDisp() http.Handler {
 		}
 		w.Write([]byte(strconv.FormatUint(count, 32)))
 	})
+	mux.HandleFunc("/ipdadmin/explain", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", SVer)
+		queryparam := r.URL.Query()
+		clip := queryparam.Get("ip")
+		if clip == "" {
+			clip = clientIP(r)
+		}
+		actionLock.Lock()
+		defer actionLock.Unlock()
+		writeJSON(w, http.StatusOK, explain(clip, queryparam.Get("host"), queryparam.Get("path")))
+	})
+	mux.HandleFunc("/ipdadmin/batch", batch)
+	mux.HandleFunc("/ipdadmin/reload", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", SVer)
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if reload() {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/ipdadmin/schedule", func(w http.ResponseWriter, r *http.Request) {
+		actionLock.Lock()
+		defer actionLock.Unlock()
+		w.Header().Set("Server", SVer)
+		queryparam := r.URL.Query()
+		ipdaction := ipdAction{}
+		ipdaction.param = map[string]string{"host": queryparam.Get("host"), "at": queryparam.Get("at")}
+		ipdaction.action = "schedule"
+		ipdActionCH <- ipdaction
+		var name string
+		select {
+		case ipdaction = <-ipdResultCH:
+			name = ipdaction.result.(string)
+		}
+		if name == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(name))
+	})
 	return mux
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dale-di/ipdispatch/ipzone"
+)
+
+const (
+	//admCacheMax 降级缓存的最大条目数，超过后清空重建
+	admCacheMax = 65536
+	//admHostMax 按域名缓存的最大条目数，泛域名下的子域名可能很多，超过后清空重建
+	admHostMax = 4096
+	//admCacheTTL 降级缓存的有效期
+	admCacheTTL = 5 * time.Minute
+)
+
+//decision 缓存的调度结果
+type decision struct {
+	res  *ipzone.Result
+	time time.Time
+}
+
+//admission 调度系统的过载保护。
+//限制同时处理的调度请求数和每秒调度请求数，超过限制时不再排队等待调度，
+//而是使用同一网段最近的调度结果，或该域名最近的调度结果跳转，都没有时返回503。
+//代理和回源改写播放列表的请求需要调度服务自己处理，降级时同样返回503
+type admission struct {
+	sem      chan struct{}
+	maxqps   int64
+	mutex    sync.Mutex
+	second   int64
+	qps      int64
+	cache    map[string]decision
+	hostlast map[string]decision
+	admitted uint64 //正常调度的请求数
+	shed     uint64 //超过限制的请求数
+	cached   uint64 //以缓存结果降级调度的请求数
+	rejected uint64 //没有缓存结果，返回503的请求数
+}
+
+//newAdmission 初始化过载保护，maxconc和maxqps为0时不限制
+func newAdmission(maxconc int, maxqps int) *admission {
+	adm := &admission{}
+	if maxconc > 0 {
+		adm.sem = make(chan struct{}, maxconc)
+	}
+	adm.maxqps = int64(maxqps)
+	adm.cache = make(map[string]decision)
+	adm.hostlast = make(map[string]decision)
+	return adm
+}
+
+//acquire 申请调度，返回false时请求应走降级流程。返回true时，处理完成后需要调用release
+func (adm *admission) acquire() bool {
+	if adm.maxqps > 0 {
+		adm.mutex.Lock()
+		now := time.Now().Unix()
+		if now != adm.second {
+			adm.second = now
+			adm.qps = 0
+		}
+		adm.qps++
+		over := adm.qps > adm.maxqps
+		adm.mutex.Unlock()
+		if over {
+			atomic.AddUint64(&adm.shed, 1)
+			return false
+		}
+	}
+	if adm.sem != nil {
+		select {
+		case adm.sem <- struct{}{}:
+		default:
+			atomic.AddUint64(&adm.shed, 1)
+			return false
+		}
+	}
+	atomic.AddUint64(&adm.admitted, 1)
+	return true
+}
+
+//release 调度完成，释放并发数
+func (adm *admission) release() {
+	if adm.sem != nil {
+		<-adm.sem
+	}
+}
+
+//remember 缓存调度结果，供降级时使用
+func (adm *admission) remember(host string, clip string, res *ipzone.Result) {
+	if res == nil {
+		return
+	}
+	host = admHost(host)
+	d := decision{res: res, time: time.Now()}
+	adm.mutex.Lock()
+	if len(adm.cache) >= admCacheMax {
+		adm.cache = make(map[string]decision)
+	}
+	if len(adm.hostlast) >= admHostMax {
+		adm.hostlast = make(map[string]decision)
+	}
+	adm.cache[admKey(host, clip)] = d
+	adm.hostlast[host] = d
+	adm.mutex.Unlock()
+}
+
+//degrade 降级调度：使用缓存的调度结果跳转，没有可用的缓存，或需要代理、回源时返回503
+func (adm *admission) degrade(w http.ResponseWriter, r *http.Request, clip string) {
+	now := time.Now()
+	host := admHost(r.Host)
+	adm.mutex.Lock()
+	d, ok := adm.cache[admKey(host, clip)]
+	if ok == false || now.Sub(d.time) > admCacheTTL {
+		d, ok = adm.hostlast[host]
+	}
+	adm.mutex.Unlock()
+	if ok && d.res.Mode() == "proxy" || ok && d.res.Mode() == "manifest" && isManifest(r.URL.Path) {
+		ok = false
+	}
+	if ok == false || now.Sub(d.time) > admCacheTTL {
+		atomic.AddUint64(&adm.rejected, 1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	atomic.AddUint64(&adm.cached, 1)
+	w.Header().Set("Location", d.res.Location(reqScheme(r), r.URL.EscapedPath(), r.URL.RawQuery, clip))
+	w.WriteHeader(d.res.Status())
+}
+
+//count 获取过载保护的统计信息
+func (adm *admission) count(item string) (count uint64) {
+	switch item {
+	case "shed":
+		count = atomic.LoadUint64(&adm.shed)
+	case "cached":
+		count = atomic.LoadUint64(&adm.cached)
+	case "rejected":
+		count = atomic.LoadUint64(&adm.rejected)
+	case "inflight":
+		count = uint64(len(adm.sem))
+	default:
+		count = atomic.LoadUint64(&adm.admitted)
+	}
+	return
+}
+
+//admHost 降级缓存使用的域名：去掉端口、末尾的点并转为小写
+func admHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+//admKey 降级缓存的key：域名+客户端IP所在的/24网段
+func admKey(host string, clip string) string {
+	if h, _, err := net.SplitHostPort(clip); err == nil {
+		clip = h
+	}
+	ip := net.ParseIP(clip)
+	if ip4 := ip.To4(); ip4 != nil {
+		return host + "|" + ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return host + "|" + clip
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dale-di/ipdispatch/ipzone"
+)
+
+//admConf 测试用的配置：r.com为跳转方式，p.com为代理方式，m.com为回源改写播放列表方式
+var admConf = map[string]string{
+	"ipz":             "1.0.0.0/8;zone1|cp1\n",
+	"r.com/node.conf": "[a]\nserver=10.0.0.1 0 100\n",
+	"r.com/view.conf": "zone1|cp1;a\n",
+	"p.com/node.conf": "[conf]\nmode=proxy\n[a]\nserver=10.0.0.2 0 100\n",
+	"p.com/view.conf": "zone1|cp1;a\n",
+	"m.com/node.conf": "[conf]\nmode=manifest\norigin=http://origin.m.com\n[a]\nserver=10.0.0.3 0 100\n",
+	"m.com/view.conf": "zone1|cp1;a\n",
+}
+
+//admResult 查询调度结果，用于写入降级缓存
+func admResult(t *testing.T, clip string, host string) *ipzone.Result {
+	t.Helper()
+	res, err := ipdisp.Query(clip, host, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestAdmissionAcquire(t *testing.T) {
+	a := newAdmission(2, 0)
+	if a.acquire() == false || a.acquire() == false {
+		t.Fatal("acquire under maxconc failed")
+	}
+	if a.acquire() {
+		t.Fatal("acquire over maxconc succeeded")
+	}
+	a.release()
+	if a.acquire() == false {
+		t.Fatal("acquire after release failed")
+	}
+	if a.count("") != 3 || a.count("shed") != 1 || a.count("inflight") != 2 {
+		t.Fatalf("admitted %d shed %d inflight %d", a.count(""), a.count("shed"), a.count("inflight"))
+	}
+
+	//跨秒时计数重置，重试
+	for try := 0; try < 3; try++ {
+		a = newAdmission(0, 3)
+		second := time.Now().Unix()
+		over := 0
+		for i := 0; i < 4; i++ {
+			if a.acquire() == false {
+				over++
+			}
+		}
+		if time.Now().Unix() != second {
+			continue
+		}
+		if over != 1 {
+			t.Fatalf("%d of 4 requests over maxqps 3", over)
+		}
+		return
+	}
+}
+
+func TestAdmissionDegrade(t *testing.T) {
+	startActions(t, admConf)
+	a := newAdmission(0, 0)
+	a.remember("r.com", "1.1.1.1", admResult(t, "1.1.1.1", "r.com"))
+	a.remember("P.com.", "1.1.1.1", admResult(t, "1.1.1.1", "p.com"))
+	a.remember("m.com:8080", "1.1.1.1", admResult(t, "1.1.1.1", "m.com"))
+	cases := []struct {
+		name     string
+		clip     string
+		host     string
+		path     string
+		status   int
+		location string
+	}{
+		{name: "same /24", clip: "1.1.1.200", host: "r.com", path: "/a.ts", status: http.StatusFound, location: "http://10.0.0.1/a.ts"},
+		{name: "host fallback", clip: "1.2.3.4", host: "R.com:80", path: "/a.ts", status: http.StatusFound, location: "http://10.0.0.1/a.ts"},
+		{name: "unknown host", clip: "1.1.1.1", host: "x.com", path: "/a.ts", status: http.StatusServiceUnavailable},
+		{name: "proxy", clip: "1.1.1.1", host: "p.com", path: "/a.ts", status: http.StatusServiceUnavailable},
+		{name: "manifest playlist", clip: "1.1.1.1", host: "m.com", path: "/live/index.m3u8", status: http.StatusServiceUnavailable},
+		{name: "manifest segment", clip: "1.1.1.1", host: "m.com", path: "/live/1.ts", status: http.StatusFound, location: "http://10.0.0.3/live/1.ts"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "http://"+c.host+c.path, nil)
+		w := httptest.NewRecorder()
+		a.degrade(w, r, c.clip)
+		if w.Code != c.status || w.Header().Get("Location") != c.location {
+			t.Errorf("%s: got %d %q, want %d %q", c.name, w.Code, w.Header().Get("Location"), c.status, c.location)
+		}
+	}
+	if a.count("cached") != 3 || a.count("rejected") != 3 {
+		t.Errorf("cached %d rejected %d", a.count("cached"), a.count("rejected"))
+	}
+
+	//过期的缓存不再使用
+	a.mutex.Lock()
+	for k, d := range a.hostlast {
+		d.time = d.time.Add(-admCacheTTL - time.Second)
+		a.hostlast[k] = d
+	}
+	for k, d := range a.cache {
+		d.time = d.time.Add(-admCacheTTL - time.Second)
+		a.cache[k] = d
+	}
+	a.mutex.Unlock()
+	w := httptest.NewRecorder()
+	a.degrade(w, httptest.NewRequest("GET", "http://r.com/a.ts", nil), "1.1.1.1")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("expired: got %d retry-after %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestAdmissionHostBound(t *testing.T) {
+	startActions(t, admConf)
+	a := newAdmission(0, 0)
+	res := admResult(t, "1.1.1.1", "r.com")
+	for i := 0; i < admHostMax+10; i++ {
+		a.remember(strconv.Itoa(i)+".r.com", "1.1.1.1", res)
+	}
+	if len(a.hostlast) > admHostMax {
+		t.Fatalf("hostlast has %d entries, max %d", len(a.hostlast), admHostMax)
+	}
+}
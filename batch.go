@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/dale-di/ipdispatch/ipzone"
+)
+
+const (
+	//batchMax 批量查询的最大条数
+	batchMax = 10000
+	//batchChunk 每次提交给调度协程的条数，各批之间释放actionLock，不阻塞正常调度
+	batchChunk = 500
+	//batchSize 批量查询请求的最大长度
+	batchSize = 8 << 20
+)
+
+//batchRow 批量查询的一条结果
+type batchRow struct {
+	IP      string `json:"ip"`
+	Host    string `json:"host,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Zone    string `json:"zone"`
+	Carrier string `json:"carrier"`
+	Node    string `json:"node,omitempty"`
+	Server  string `json:"server,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+//batch 批量查询IP所在的区域、运营商，以及调度到的节点和服务器。
+//每行为：ip[,host[,path]]，没有host、path时使用参数中的host、path；host为空时只查找区域和运营商。
+//请求内容可以是POST的body，也可以是上传的文件（file字段），或者多个ip参数
+func batch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", SVer)
+	queryparam := r.URL.Query()
+	items, err := batchItems(r, queryparam.Get("host"), queryparam.Get("path"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	rows := make([]batchRow, 0, len(items))
+	for start := 0; start < len(items); start += batchChunk {
+		end := start + batchChunk
+		if end > len(items) {
+			end = len(items)
+		}
+		actionLock.Lock()
+		ipdActionCH <- ipdAction{action: "batch", result: items[start:end]}
+		ipdaction := <-ipdResultCH
+		actionLock.Unlock()
+		for i, tr := range ipdaction.result.([]*ipzone.Trace) {
+			item := items[start+i]
+			rows = append(rows, batchRow{IP: tr.ClientIP, Host: item[1], Path: item[2], Zone: tr.Zone,
+				Carrier: tr.Carrier, Node: tr.Node, Server: tr.IP, Error: tr.Error})
+		}
+	}
+	if queryparam.Get("format") != "csv" {
+		writeJSON(w, http.StatusOK, rows)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"ip", "host", "path", "zone", "carrier", "node", "server", "error"})
+	for _, row := range rows {
+		cw.Write([]string{row.IP, row.Host, row.Path, row.Zone, row.Carrier, row.Node, row.Server, row.Error})
+	}
+	cw.Flush()
+}
+
+//batchItems 读取批量查询的列表
+func batchItems(r *http.Request, host string, path string) (items [][3]string, err error) {
+	var body io.Reader
+	switch {
+	case strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data"):
+		if err = r.ParseMultipartForm(batchSize); err != nil {
+			return
+		}
+		f, _, ferr := r.FormFile("file")
+		if ferr != nil {
+			return nil, ferr
+		}
+		defer f.Close()
+		body = f
+	case r.Method == http.MethodPost:
+		body = r.Body
+	}
+	for _, ip := range r.URL.Query()["ip"] {
+		items = append(items, [3]string{ip, host, path})
+	}
+	if body != nil {
+		cr := csv.NewReader(io.LimitReader(body, batchSize))
+		cr.Comment = '#'
+		cr.FieldsPerRecord = -1
+		cr.TrimLeadingSpace = true
+		for {
+			record, rerr := cr.Read()
+			if rerr == io.EOF {
+				break
+			}
+			if rerr != nil {
+				return nil, rerr
+			}
+			item := [3]string{"", host, path}
+			for i := 0; i < len(record) && i < 3; i++ {
+				if v := strings.TrimSpace(record[i]); v != "" {
+					item[i] = v
+				}
+			}
+			if item[0] != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	if len(items) == 0 {
+		return nil, errors.New("no ip")
+	}
+	if len(items) > batchMax {
+		return nil, errors.New("too many ips")
+	}
+	return
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	startActions(t, testConf)
+	//超过一批的条数，结果按请求的顺序返回
+	var body strings.Builder
+	var ips []string
+	for i := 0; i < batchChunk*2+1; i++ {
+		ip := fmt.Sprintf("1.0.%d.%d", i/256, i%256)
+		ips = append(ips, ip)
+		body.WriteString(ip + "\n")
+	}
+	body.WriteString("# 注释\n127.0.0.1,,/x\nbad,t.com\n1.2.3.4,nohost.com\n")
+	r := httptest.NewRequest("POST", "/ipdadmin/batch?host=t.com&path=/a", strings.NewReader(body.String()))
+	w := httptest.NewRecorder()
+	batch(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var rows []batchRow
+	if err := json.Unmarshal(w.Body.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(ips)+3 {
+		t.Fatalf("got %d rows, want %d", len(rows), len(ips)+3)
+	}
+	for i, ip := range ips {
+		row := rows[i]
+		if row.IP != ip || row.Host != "t.com" || row.Path != "/a" || row.Zone != "zone1|cp1" || row.Carrier != "cp1" || row.Node != "a" || row.Error != "" {
+			t.Fatalf("row %d: %+v", i, row)
+		}
+	}
+	tail := rows[len(ips):]
+	//行中host为空时使用参数中的host
+	if tail[0].IP != "127.0.0.1" || tail[0].Host != "t.com" || tail[0].Path != "/x" || tail[0].Zone != "zone127|cp127" || tail[0].Node != "b" {
+		t.Errorf("default host row: %+v", tail[0])
+	}
+	if tail[1].IP != "bad" || tail[1].Error == "" {
+		t.Errorf("bad ip row: %+v", tail[1])
+	}
+	if tail[2].Host != "nohost.com" || tail[2].Zone != "zone1|cp1" || tail[2].Error == "" {
+		t.Errorf("unknown host row: %+v", tail[2])
+	}
+}
+
+func TestBatchRequest(t *testing.T) {
+	startActions(t, testConf)
+	r := httptest.NewRequest("GET", "/ipdadmin/batch?ip=1.1.1.1&ip=2.2.2.2&format=csv", nil)
+	w := httptest.NewRecorder()
+	batch(w, r)
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(records) != 3 || records[1][0] != "1.1.1.1" || records[1][3] != "zone1|cp1" || records[2][0] != "2.2.2.2" {
+		t.Errorf("csv: %d %q", w.Code, records)
+	}
+
+	for _, c := range []struct {
+		name string
+		url  string
+		body string
+	}{
+		{name: "empty", url: "/ipdadmin/batch", body: "# 只有注释\n"},
+		{name: "too many", url: "/ipdadmin/batch", body: strings.Repeat("1.1.1.1\n", batchMax+1)},
+	} {
+		w := httptest.NewRecorder()
+		batch(w, httptest.NewRequest("POST", c.url, strings.NewReader(c.body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", c.name, w.Code)
+		}
+	}
+}
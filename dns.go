@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/dale-di/ipdispatch/ipzone"
+	"github.com/miekg/dns"
+)
+
+//serveDNS 在addr上启动UDP和TCP的DNS服务，以同一套调度配置应答A/AAAA查询。
+//开启端口复用，平滑重启时新进程可以在原进程退出前监听同一端口
+func serveDNS(addr string) {
+	handler := dns.HandlerFunc(dnsQuery)
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &dns.Server{Addr: addr, Net: network, Handler: handler, ReusePort: true}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil {
+				fmt.Fprintf(os.Stderr, "DNS %s: %v\n", srv.Net, err)
+			}
+		}()
+	}
+}
+
+//dnsQuery 应答DNS查询。客户端IP优先使用EDNS Client Subnet中的地址，其次为递归服务器的地址。
+//DNS查询没有请求路径，哈希调度（balance=h）以客户端IP作为哈希的字符串，同一客户端网段落在同一服务器。
+//未配置的域名返回REFUSED，A/AAAA以外的查询不调度，返回没有记录的应答（NOERROR/NODATA）
+func dnsQuery(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	defer w.WriteMsg(m)
+	if len(req.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		return
+	}
+	q := req.Question[0]
+	host := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	clip, ecs := dnsClientIP(w, req)
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), false)
+		if ecs != nil {
+			//应答按客户端网段调度，作用范围与请求的网段相同
+			ecs.SourceScope = ecs.SourceNetmask
+			m.IsEdns0().Option = append(m.IsEdns0().Option, ecs)
+		}
+	}
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return
+	}
+	if adm.acquire() == false {
+		m.Rcode = dns.RcodeServerFailure
+		return
+	}
+	defer adm.release()
+	actionLock.Lock()
+	ipdActionCH <- ipdAction{action: "dns", param: map[string]string{"clip": clip, "host": host, "path": clip}}
+	ipdaction := <-ipdResultCH
+	actionLock.Unlock()
+	rsv := ipdaction.result.(*resolution)
+	if rsv.err != nil {
+		m.Rcode = dns.RcodeServerFailure
+		if ipzone.Reason(rsv.err) == ipzone.FailHost {
+			m.Rcode = dns.RcodeRefused
+			m.Authoritative = false
+		}
+		return
+	}
+	res := rsv.res
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: uint32(res.TTL())}
+	if cdnhost := res.CDNHost(); cdnhost != "" {
+		hdr.Rrtype = dns.TypeCNAME
+		m.Answer = append(m.Answer, &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(cdnhost)})
+		return
+	}
+	hdr.Rrtype = q.Qtype
+	seen := make(map[string]bool)
+	for _, r := range append([]*ipzone.Result{res}, rsv.alts...) {
+		ip := net.ParseIP(r.IP)
+		if ip == nil || seen[r.IP] || len(m.Answer) >= res.DNSNum() {
+			continue
+		}
+		seen[r.IP] = true
+		if ip4 := ip.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+		} else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+}
+
+//dnsClientIP 返回调度使用的客户端IP。请求带有EDNS Client Subnet时使用其中的地址，并返回该选项
+func dnsClientIP(w dns.ResponseWriter, req *dns.Msg) (clip string, ecs *dns.EDNS0_SUBNET) {
+	if opt := req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok && subnet.SourceNetmask > 0 {
+				return subnet.Address.String(), subnet
+			}
+		}
+	}
+	clip = w.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(clip); err == nil {
+		clip = host
+	}
+	return
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dale-di/ipdispatch/ipzone"
+	"github.com/miekg/dns"
+)
+
+//testConf 测试用的配置：t.com的zone1调度到节点a（两台服务器），其他区域调度到默认节点b；v6.com只有IPv6地址；
+//one.com的节点有两台服务器，dnsnum为默认的1
+var testConf = map[string]string{
+	"ipz":               "1.0.0.0/8;zone1|cp1\n127.0.0.0/8;zone127|cp127\n",
+	"t.com/node.conf":   "[conf]\nttl=30\ndnsnum=2\n[a]\nserver=10.0.0.1 0 50\nserver=10.0.0.2 1 50\n[b]\ndefault=yes\nserver=10.0.0.9 0 100\n",
+	"t.com/view.conf":   "zone1|cp1;a\n",
+	"v6.com/node.conf":  "[a]\nserver=2001:db8::1 0 100\n",
+	"v6.com/view.conf":  "zone1|cp1;a\n",
+	"one.com/node.conf": "[a]\nserver=10.0.1.1 0 50\nserver=10.0.1.2 1 50\n",
+	"one.com/view.conf": "zone1|cp1;a\n",
+}
+
+//startActions 加载配置，以新的通道启动调度协程。conf的key为相对配置目录的文件名
+func startActions(t *testing.T, conf map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range conf {
+		fname := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ins := ipzone.New()
+	if err := ins.Init(dir); err != nil {
+		t.Fatal(err)
+	}
+	//之前测试的请求在持有actionLock时读取这些变量
+	actionLock.Lock()
+	defer actionLock.Unlock()
+	ipdisp = ins
+	adm = newAdmission(0, 0)
+	ipdActionCH = make(chan ipdAction, 1)
+	ipdResultCH = make(chan ipdAction, 1)
+	go actions(ins, ipdActionCH, ipdResultCH)
+}
+
+//startDNS 加载testConf，启动调度协程和DNS服务，返回DNS服务的地址
+func startDNS(t *testing.T) string {
+	t.Helper()
+	startActions(t, testConf)
+	//取一个空闲端口
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	serveDNS(addr)
+	return addr
+}
+
+//exchange 发送查询，DNS服务启动前重试
+func exchange(t *testing.T, addr string, m *dns.Msg) *dns.Msg {
+	t.Helper()
+	c := &dns.Client{Timeout: 200 * time.Millisecond}
+	var err error
+	for i := 0; i < 20; i++ {
+		var r *dns.Msg
+		if r, _, err = c.Exchange(m, addr); err == nil {
+			return r
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("exchange %s: %v", m.Question[0].Name, err)
+	return nil
+}
+
+func TestDNS(t *testing.T) {
+	addr := startDNS(t)
+	cases := []struct {
+		name  string
+		qname string
+		qtype uint16
+		ecs   string
+		rcode int
+		ips   []string
+		n     int //应答的地址数，不为0时ips为可能的地址
+	}{
+		{name: "A with ecs", qname: "t.com.", qtype: dns.TypeA, ecs: "1.2.3.0", ips: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "A without ecs", qname: "t.com.", qtype: dns.TypeA, ips: []string{"10.0.0.9"}},
+		{name: "A case insensitive", qname: "T.Com.", qtype: dns.TypeA, ecs: "1.2.3.0", ips: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "AAAA", qname: "v6.com.", qtype: dns.TypeAAAA, ecs: "1.2.3.0", ips: []string{"2001:db8::1"}},
+		{name: "AAAA of ipv4 host", qname: "t.com.", qtype: dns.TypeAAAA, ecs: "1.2.3.0"},
+		{name: "A of ipv6 host", qname: "v6.com.", qtype: dns.TypeA, ecs: "1.2.3.0"},
+		{name: "dnsnum 1", qname: "one.com.", qtype: dns.TypeA, ecs: "1.2.3.0", ips: []string{"10.0.1.1", "10.0.1.2"}, n: 1},
+		{name: "unknown zone", qname: "other.com.", qtype: dns.TypeA, rcode: dns.RcodeRefused},
+		{name: "MX", qname: "t.com.", qtype: dns.TypeMX},
+		{name: "TXT", qname: "t.com.", qtype: dns.TypeTXT},
+		{name: "ANY", qname: "t.com.", qtype: dns.TypeANY},
+	}
+	for _, c := range cases {
+		m := new(dns.Msg)
+		m.SetQuestion(c.qname, c.qtype)
+		if c.ecs != "" {
+			m.SetEdns0(4096, false)
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(c.ecs).To4()})
+		}
+		r := exchange(t, addr, m)
+		if r.Rcode != c.rcode {
+			t.Errorf("%s: rcode = %s, want %s", c.name, dns.RcodeToString[r.Rcode], dns.RcodeToString[c.rcode])
+			continue
+		}
+		var ips []string
+		for _, rr := range r.Answer {
+			switch a := rr.(type) {
+			case *dns.A:
+				ips = append(ips, a.A.String())
+			case *dns.AAAA:
+				ips = append(ips, a.AAAA.String())
+			}
+			if rr.Header().Ttl != 30 && strings.ToLower(c.qname) == "t.com." {
+				t.Errorf("%s: ttl = %d, want 30", c.name, rr.Header().Ttl)
+			}
+		}
+		if c.n > 0 {
+			valid := len(ips) == c.n && len(r.Answer) == c.n
+			for _, ip := range ips {
+				i := sort.SearchStrings(c.ips, ip)
+				valid = valid && i < len(c.ips) && c.ips[i] == ip
+			}
+			if valid == false {
+				t.Errorf("%s: answer = %v, want %d of %v", c.name, r.Answer, c.n, c.ips)
+			}
+			continue
+		}
+		sort.Strings(ips)
+		if len(ips) != len(c.ips) || len(r.Answer) != len(c.ips) {
+			t.Errorf("%s: answer = %v, want %v", c.name, r.Answer, c.ips)
+			continue
+		}
+		for i := range ips {
+			if ips[i] != c.ips[i] {
+				t.Errorf("%s: answer = %v, want %v", c.name, ips, c.ips)
+				break
+			}
+		}
+		if c.ecs != "" && c.rcode == dns.RcodeSuccess {
+			opt := r.IsEdns0()
+			if opt == nil || len(opt.Option) == 0 {
+				t.Errorf("%s: no ecs in answer", c.name)
+			} else if ecs, ok := opt.Option[0].(*dns.EDNS0_SUBNET); ok == false || ecs.SourceScope != 24 {
+				t.Errorf("%s: ecs = %v, want scope 24", c.name, opt.Option[0])
+			}
+		}
+	}
+}
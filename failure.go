@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/dale-di/ipdispatch/ipzone"
+)
+
+//failure 全局的调度失败处理方式，用于未配置域名和没有设置处理方式的域名
+var failure = &ipzone.Failure{}
+
+//initFailure 根据命令行参数设置全局的调度失败处理方式
+func initFailure() (err error) {
+	for key, value := range map[string]string{"fail": *failact, "failurl": *failurl, "failbody": *failbody} {
+		if value == "" {
+			continue
+		}
+		if err = failure.Set(key, value); err != nil {
+			return
+		}
+	}
+	failure.Retry = *failretry
+	return failure.Check()
+}
+
+//loadDisp 加载配置，并检查各域名以全局设置补全后的调度失败处理方式
+func loadDisp(cfpath string) (ins *ipzone.IPDisp, err error) {
+	ins = ipzone.New()
+	if err = ins.Init(cfpath); err != nil {
+		return
+	}
+	err = ins.CheckFailure(failure)
+	return
+}
+
+//fail 按处理方式响应调度失败的请求：跳转到备用地址，或返回状态码和响应内容
+func fail(w http.ResponseWriter, r *http.Request, clip string, rsv *resolution) {
+	//域名设置的配置项覆盖全局的处理方式
+	f := rsv.failure.Merge(failure)
+	reason := ipzone.Reason(rsv.err)
+	if f.Retry > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(f.Retry))
+	}
+	if f.Action == "redirect" {
+		w.Header().Set("Location", f.Expand(f.URL, r.Host, r.URL.EscapedPath(), r.URL.RawQuery, clip, reason))
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	status, err := strconv.Atoi(f.Action)
+	if err != nil {
+		status = http.StatusServiceUnavailable
+		if reason == ipzone.FailHost {
+			status = http.StatusNotFound
+		}
+	}
+	if f.Body == "" {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(f.Expand(f.Body, r.Host, r.URL.EscapedPath(), r.URL.RawQuery, clip, reason)))
+}
@@ -0,0 +1,57 @@
+package ipzone
+
+import "time"
+
+//Alternates 返回调度结果的备选列表，供客户端自行故障切换，最多n个，n为0时不限。
+//依次为同节点中状态为up的其他服务器、overflow链和区域后备节点中状态为up的节点，
+//其他节点从负载均衡的当前服务器开始选择第一台状态为up的服务器。只用于查询，不计入请求统计
+func (res *Result) Alternates(n int) (alts []*Result) {
+	add := func(node *Node, svr *Server) bool {
+		alt := &Result{Zone: res.Zone, Node: node.name, host: res.host, vhost: res.vhost, node: node, server: svr}
+		if svr != nil {
+			alt.IP = svr.addr(zoneCarrier(res.Zone), node.linefallback)
+		}
+		alts = append(alts, alt)
+		return n > 0 && len(alts) >= n
+	}
+	if svr := res.server; svr != nil {
+		for next := svr.next; next != nil && next != svr; next = next.next {
+			if next.status == 0 && add(res.node, next) {
+				return
+			}
+		}
+	}
+	seen := map[*Node]bool{res.node: true}
+	now := time.Now()
+	for _, chain := range [][]int{res.node.overflowchain, res.fallback} {
+		for _, nid := range chain {
+			node := res.vhost.nodes[nid]
+			if seen[node] || node.status != 0 {
+				continue
+			}
+			seen[node] = true
+			if node.cdn != nil {
+				if node.cdn.full(node, res.vhost, now) == false && add(node, nil) {
+					return
+				}
+				continue
+			}
+			if svr := node.upserver(); svr != nil && add(node, svr) {
+				return
+			}
+		}
+	}
+	return
+}
+
+//upserver 从负载均衡的当前服务器开始，返回第一台状态为up的服务器，没有时返回nil
+func (node *Node) upserver() *Server {
+	svr := node.curserver
+	for i := 0; i < node.servercount && svr != nil; i++ {
+		if svr.status == 0 {
+			return svr
+		}
+		svr = svr.next
+	}
+	return nil
+}
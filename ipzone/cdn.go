@@ -0,0 +1,83 @@
+package ipzone
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+//CDN 第三方CDN配置。在node.conf中以[cdn:name]段定义，可以作为overflow2node的目标
+type CDN struct {
+	host      string //CDN的域名（CNAME）
+	url       string //跳转地址模板
+	signkey   string //鉴权密钥，为空时不签名
+	signparam string //鉴权参数名
+	maxshare  int    //最多调度到此CDN的请求比例（百分比），0为不限
+	reqwin    *window
+}
+
+const (
+	//cdnWindow 统计CDN请求比例的时间窗口
+	cdnWindow = time.Minute
+	//cdnURL 默认跳转地址模板
+	cdnURL = "{scheme}://{cdn_host}{path}"
+)
+
+//newCDN 初始化第三方CDN配置
+func newCDN() *CDN {
+	cdn := &CDN{}
+	cdn.url = cdnURL
+	cdn.signparam = "auth_key"
+	cdn.reqwin = newWindow(cdnWindow)
+	return cdn
+}
+
+//set 设置CDN的配置项，不是CDN的配置项时返回false
+func (cdn *CDN) set(key string, value string) (ok bool, err error) {
+	ok = true
+	switch key {
+	case "host":
+		cdn.host = value
+	case "url":
+		cdn.url = value
+	case "signkey":
+		cdn.signkey = value
+	case "signparam":
+		cdn.signparam = value
+	case "maxshare":
+		cdn.maxshare, err = strconv.Atoi(value)
+	default:
+		ok = false
+	}
+	return
+}
+
+//full 调度到此CDN的请求比例或带宽是否已达上限
+func (cdn *CDN) full(node *Node, vhost *Vhost, now time.Time) bool {
+	if node.maxbw > 0 && node.bw >= node.maxbw {
+		return true
+	}
+	if cdn.maxshare > 0 {
+		total := vhost.reqwin.count(now)
+		return (cdn.reqwin.count(now)+1)*100 > total*float64(cdn.maxshare)
+	}
+	return false
+}
+
+//signurl 为跳转地址加上鉴权参数，没有设置鉴权密钥时不签名
+func (cdn *CDN) signurl(loc string, path string, now time.Time) string {
+	if cdn.signkey == "" {
+		return loc
+	}
+	return addquery(loc, cdn.signparam+"="+cdn.sign(path, now))
+}
+
+//sign 生成A类型鉴权串：timestamp-rand-uid-md5(uri-timestamp-rand-uid-key)
+func (cdn *CDN) sign(uri string, now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	rnd := strconv.FormatUint(uint64(rand.Uint32()), 16)
+	hash := md5.Sum([]byte(uri + "-" + ts + "-" + rnd + "-0-" + cdn.signkey))
+	return ts + "-" + rnd + "-0-" + hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,135 @@
+package ipzone
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//调度失败的原因
+const (
+	FailHost = "host" //没有配置该域名
+	FailIP   = "ip"   //客户端IP无效
+	FailNode = "node" //没有可用的节点
+)
+
+//QueryError 调度失败的错误
+type QueryError struct {
+	Reason string //失败原因：host、ip或node
+	msg    string
+}
+
+//Error 实现error接口
+func (e *QueryError) Error() string {
+	return e.msg
+}
+
+//Reason 返回调度失败的原因，不是调度失败的错误时返回空
+func Reason(err error) string {
+	var qe *QueryError
+	if errors.As(err, &qe) {
+		return qe.Reason
+	}
+	return ""
+}
+
+//fail 记录调度失败的原因，返回调度失败的错误
+func (ipdisp *IPDisp) fail(reason string, msg string) error {
+	ipdisp.failcount[reason]++
+	return &QueryError{Reason: reason, msg: msg}
+}
+
+//Failure 调度失败时的处理方式。在node.conf的[conf]段中设置域名的处理方式，
+//没有设置或没有配置该域名时，使用命令行参数设置的全局处理方式
+type Failure struct {
+	Action string //redirect：跳转到URL；404、503等：返回该状态码和Body；为空时未配置域名返回404，其他返回503
+	URL    string //跳转地址模板
+	Body   string //响应内容模板
+	Retry  int    //Retry-After的秒数，0为不设置
+	retry  bool   //是否设置了failretry
+}
+
+//Set 设置调度失败处理方式的配置项：fail、failurl、failbody、failretry
+func (f *Failure) Set(key string, value string) (err error) {
+	switch key {
+	case "fail":
+		if value != "redirect" {
+			if status, serr := strconv.Atoi(value); serr != nil || status < 400 || status > 599 {
+				return errors.New("not valid fail: " + value)
+			}
+		}
+		f.Action = value
+	case "failurl":
+		f.URL = value
+	case "failbody":
+		f.Body = value
+	case "failretry":
+		if f.Retry, err = strconv.Atoi(value); err != nil || f.Retry < 0 {
+			err = errors.New("not valid failretry: " + value)
+		}
+		f.retry = true
+	default:
+		err = errors.New("not valid fail config: " + key)
+	}
+	return
+}
+
+//Check 检查处理方式的配置是否完整
+func (f *Failure) Check() error {
+	if f.Action == "redirect" && f.URL == "" {
+		return errors.New("fail=redirect without failurl")
+	}
+	return nil
+}
+
+//Merge 返回以f中设置的配置项逐项覆盖base后的处理方式，f中没有设置的配置项使用base的，f为nil时返回base
+func (f *Failure) Merge(base *Failure) *Failure {
+	if f == nil {
+		return base
+	}
+	m := *base
+	if f.Action != "" {
+		m.Action = f.Action
+	}
+	if f.URL != "" {
+		m.URL = f.URL
+	}
+	if f.Body != "" {
+		m.Body = f.Body
+	}
+	if f.retry {
+		m.Retry = f.Retry
+		m.retry = true
+	}
+	return &m
+}
+
+//Expand 展开跳转地址或响应内容模板。可用变量：{host}、{path}、{query}、{ip}：客户端IP；{reason}：失败原因
+func (f *Failure) Expand(tmpl string, host string, path string, query string, clip string, reason string) string {
+	return strings.NewReplacer(
+		"{host}", host,
+		"{path}", path,
+		"{query}", query,
+		"{ip}", clip,
+		"{reason}", reason,
+	).Replace(tmpl)
+}
+
+//Failure 返回域名配置的调度失败处理方式，没有配置该域名或没有设置时返回nil
+func (ipdisp *IPDisp) Failure(host string) *Failure {
+	if vhost, ok := ipdisp.match(host); ok {
+		return vhost.failure
+	}
+	return nil
+}
+
+//CheckFailure 检查各域名的调度失败处理方式。域名没有设置的配置项使用全局的处理方式base，
+//所以只设置了fail=redirect、由全局设置failurl的域名是有效的
+func (ipdisp *IPDisp) CheckFailure(base *Failure) error {
+	for name, vhost := range ipdisp.vhosts {
+		if err := vhost.failure.Merge(base).Check(); err != nil {
+			return errors.New(name + ": conf: " + err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package ipzone
+
+import "testing"
+
+func TestFailureMerge(t *testing.T) {
+	base := &Failure{Action: "redirect", URL: "http://backup.t.com{path}", Body: "busy", Retry: 5}
+	cases := []struct {
+		name string
+		sets [][2]string
+		want Failure
+	}{
+		{name: "not set", want: *base},
+		{name: "status only", sets: [][2]string{{"fail", "503"}}, want: Failure{Action: "503", URL: base.URL, Body: "busy", Retry: 5}},
+		{name: "url only", sets: [][2]string{{"failurl", "http://b.t.com/"}}, want: Failure{Action: "redirect", URL: "http://b.t.com/", Body: "busy", Retry: 5}},
+		{name: "body and retry", sets: [][2]string{{"failbody", "down"}, {"failretry", "0"}}, want: Failure{Action: "redirect", URL: base.URL, Body: "down", Retry: 0}},
+	}
+	for _, c := range cases {
+		var f *Failure
+		if len(c.sets) > 0 {
+			f = &Failure{}
+			for _, kv := range c.sets {
+				if err := f.Set(kv[0], kv[1]); err != nil {
+					t.Fatalf("%s: %v", c.name, err)
+				}
+			}
+		}
+		m := f.Merge(base)
+		if m.Action != c.want.Action || m.URL != c.want.URL || m.Body != c.want.Body || m.Retry != c.want.Retry {
+			t.Errorf("%s: got %+v, want %+v", c.name, *m, c.want)
+		}
+	}
+	if base.Action != "redirect" || base.Body != "busy" {
+		t.Errorf("base changed: %+v", *base)
+	}
+}
+
+func TestCheckFailure(t *testing.T) {
+	cases := []struct {
+		name string
+		conf string
+		base Failure
+		ok   bool
+	}{
+		{name: "not set", ok: true},
+		{name: "redirect with global failurl", conf: "fail=redirect\n", base: Failure{URL: "http://backup.t.com/"}, ok: true},
+		{name: "global redirect with host failurl", conf: "failurl=http://b.t.com/\n", base: Failure{Action: "redirect"}, ok: true},
+		{name: "redirect without failurl", conf: "fail=redirect\n"},
+		{name: "global redirect without failurl", conf: "fail=503\n", base: Failure{Action: "redirect"}, ok: true},
+	}
+	for _, c := range cases {
+		ipdisp := newTestDisp(t, map[string]string{
+			"t.com/node.conf": "[conf]\n" + c.conf + "[a]\nserver=10.0.0.1 0 100\n",
+			"t.com/view.conf": "zone1|cp1;a\n",
+		})
+		base := c.base
+		if err := ipdisp.CheckFailure(&base); (err == nil) != c.ok {
+			t.Errorf("%s: err = %v, want ok %v", c.name, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package ipzone
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//geo 经纬度坐标
+type geo struct {
+	lat float64
+	lon float64
+}
+
+//parseGeo 解析“纬度,经度”格式的坐标
+func parseGeo(s string) (g *geo, err error) {
+	ll := strings.Split(s, ",")
+	if len(ll) != 2 {
+		return nil, errors.New("not valid geo: " + s)
+	}
+	g = &geo{}
+	if g.lat, err = strconv.ParseFloat(strings.TrimSpace(ll[0]), 64); err != nil {
+		return nil, err
+	}
+	if g.lon, err = strconv.ParseFloat(strings.TrimSpace(ll[1]), 64); err != nil {
+		return nil, err
+	}
+	return
+}
+
+//distance 两点之间的球面距离（km）
+func (g *geo) distance(o *geo) float64 {
+	const r = 6371
+	rad := math.Pi / 180
+	dlat := (o.lat - g.lat) * rad
+	dlon := (o.lon - g.lon) * rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(g.lat*rad)*math.Cos(o.lat*rad)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * r * math.Asin(math.Sqrt(a))
+}
+
+//zoneRegion 返回区域名称中的地域部分，区域名称的格式为：地域|运营商
+func zoneRegion(zonename string) string {
+	if i := strings.Index(zonename, "|"); i >= 0 {
+		return zonename[:i]
+	}
+	return zonename
+}
+
+//zoneCarrier 返回区域名称中的运营商部分
+func zoneCarrier(zonename string) string {
+	if i := strings.Index(zonename, "|"); i >= 0 {
+		return zonename[i+1:]
+	}
+	return ""
+}
+
+//LoadGeo 读取区域的坐标，文件不存在时不使用距离选择后备节点。
+//每行格式为：区域;纬度,经度。区域可以是完整的区域名称，也可以只是地域部分
+func (ipdisp *IPDisp) LoadGeo(conf string) (err error) {
+	ipdisp.zonegeo = make(map[int]*geo)
+	var flines []string
+	flines, err = file2string(conf)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	geos := make(map[string]*geo)
+	for _, fline := range flines {
+		if len(fline) == 0 || fline[0] == '#' {
+			continue
+		}
+		sline := strings.Split(fline, ";")
+		if len(sline) != 2 {
+			continue
+		}
+		var g *geo
+		if g, err = parseGeo(sline[1]); err != nil {
+			err = errors.New(conf + " " + err.Error())
+			return
+		}
+		geos[sline[0]] = g
+	}
+	for zonename, zid := range ipdisp.zoneID {
+		if g, ok := geos[zonename]; ok {
+			ipdisp.zonegeo[zid] = g
+		} else if g, ok := geos[zoneRegion(zonename)]; ok {
+			ipdisp.zonegeo[zid] = g
+		}
+	}
+	return
+}
+
+//serves 节点是否服务于该运营商，未配置carrier时服务于所有运营商
+func (node *Node) serves(carrier string) bool {
+	if len(node.carriers) == 0 {
+		return true
+	}
+	for _, c := range node.carriers {
+		if c == carrier {
+			return true
+		}
+	}
+	return false
+}
+
+//initfallback 计算每个区域的后备节点：view.conf中配置的后备节点在前，
+//其后是有坐标且服务于同一运营商的节点，按距离由近到远排列
+func (ipdisp *IPDisp) initfallback(vhost *Vhost, v *view) {
+	for zonename, zid := range ipdisp.zoneID {
+		route, mapped := v.zone2node[zid]
+		seen := make(map[int]bool)
+		var fallback []int
+		if mapped {
+			//按权重分配时，主节点不固定，所有节点都作为后备节点
+			start := 1
+			if v.zoneweight[zid] != nil {
+				start = 0
+			} else {
+				seen[route[0]] = true
+			}
+			for _, nid := range route[start:] {
+				if seen[nid] == false {
+					seen[nid] = true
+					fallback = append(fallback, nid)
+				}
+			}
+		} else {
+			seen[vhost.defaultNode] = true
+		}
+		zg, ok := ipdisp.zonegeo[zid]
+		if ok == false {
+			v.zonefallback[zid] = fallback
+			continue
+		}
+		carrier := zoneCarrier(zonename)
+		var near []*Node
+		for _, node := range vhost.nodes {
+			if node.geo != nil && seen[node.id] == false && node.serves(carrier) {
+				near = append(near, node)
+			}
+		}
+		sort.SliceStable(near, func(i, j int) bool {
+			return zg.distance(near[i].geo) < zg.distance(near[j].geo)
+		})
+		for _, node := range near {
+			fallback = append(fallback, node.id)
+		}
+		v.zonefallback[zid] = fallback
+	}
+}
+
+//Report 输出每个域名下，每个区域的主节点和后备节点顺序
+func (ipdisp *IPDisp) Report(w io.Writer) {
+	var hosts []string
+	for host := range ipdisp.vhosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var zones []string
+	for zonename := range ipdisp.zoneID {
+		zones = append(zones, zonename)
+	}
+	sort.Strings(zones)
+	for _, host := range hosts {
+		vhost := ipdisp.vhosts[host]
+		fmt.Fprintf(w, "[%s]\n", host)
+		for _, zonename := range zones {
+			zid := ipdisp.zoneID[zonename]
+			var names []string
+			switch {
+			case vhost.view.zoneweight[zid] != nil:
+				//按权重分配时，输出各节点的权重
+				var weights []string
+				for i, nid := range vhost.view.zone2node[zid] {
+					weights = append(weights, vhost.nodes[nid].name+":"+strconv.Itoa(vhost.view.zoneweight[zid][i]))
+				}
+				names = append(names, strings.Join(weights, "/"))
+			case len(vhost.view.zone2node[zid]) > 0:
+				names = append(names, vhost.nodes[vhost.view.zone2node[zid][0]].name)
+			default:
+				//未配置的区域，调度到默认节点
+				names = append(names, vhost.nodes[vhost.defaultNode].name+"(default)")
+			}
+			for _, nid := range vhost.view.zonefallback[zid] {
+				node := vhost.nodes[nid]
+				if zg, ok := ipdisp.zonegeo[zid]; ok && node.geo != nil {
+					names = append(names, fmt.Sprintf("%s(%.0fkm)", node.name, zg.distance(node.geo)))
+				} else {
+					names = append(names, node.name)
+				}
+			}
+			fmt.Fprintf(w, "%s;%s\n", zonename, strings.Join(names, ","))
+		}
+	}
+}
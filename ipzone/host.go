@@ -0,0 +1,98 @@
+package ipzone
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+//hostname 规范化域名：去掉端口和末尾的“.”，转为小写
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+//sethost 设置[conf]段中域名相关的配置项
+func (vhost *Vhost) sethost(key string, value string) (err error) {
+	switch key {
+	case "alias":
+		//alias=a.test.com[,b.test.com...]，可以有多行
+		for _, alias := range strings.Split(value, ",") {
+			if alias = hostname(strings.TrimSpace(alias)); alias != "" {
+				vhost.aliases = append(vhost.aliases, alias)
+			}
+		}
+	case "catchall":
+		switch value {
+		case "yes":
+			vhost.catchall = true
+		case "no":
+			vhost.catchall = false
+		default:
+			err = errors.New("not valid catchall: " + value)
+		}
+	}
+	return
+}
+
+//inithosts 登记所有域名和别名。以“*.”开头的为通配符域名，只匹配其下一级子域名。
+//同一域名登记到多个虚拟主机，或有多个catchall时返回错误
+func (ipdisp *IPDisp) inithosts() (err error) {
+	ipdisp.hosts = make(map[string]*Vhost)
+	ipdisp.wildcards = make(map[string]*Vhost)
+	ipdisp.catchall = nil
+	for name, vhost := range ipdisp.vhosts {
+		for _, host := range append([]string{hostname(name)}, vhost.aliases...) {
+			hosts := ipdisp.hosts
+			if strings.HasPrefix(host, "*.") {
+				hosts = ipdisp.wildcards
+				host = host[1:]
+			}
+			if other, ok := hosts[host]; ok && other != vhost {
+				return errors.New("duplicate host: " + host + " in " + name + " and " + other.name)
+			}
+			hosts[host] = vhost
+		}
+		if vhost.catchall {
+			if ipdisp.catchall != nil {
+				return errors.New("duplicate catchall: " + name + " and " + ipdisp.catchall.name)
+			}
+			ipdisp.catchall = vhost
+		}
+	}
+	return
+}
+
+//lookup 按域名、别名、通配符域名查找虚拟主机。通配符域名与证书相同，只匹配一级子域名：
+//*.example.com匹配a.example.com，不匹配a.b.example.com。host可以带端口
+func (ipdisp *IPDisp) lookup(host string) (*Vhost, bool) {
+	host = hostname(host)
+	if vhost, ok := ipdisp.hosts[host]; ok {
+		return vhost, true
+	}
+	if i := strings.Index(host, "."); i > 0 {
+		if vhost, ok := ipdisp.wildcards[host[i:]]; ok {
+			return vhost, true
+		}
+	}
+	return nil, false
+}
+
+//match 查找处理请求的虚拟主机，没有匹配的域名时使用catchall
+func (ipdisp *IPDisp) match(host string) (*Vhost, bool) {
+	if vhost, ok := ipdisp.lookup(host); ok {
+		return vhost, true
+	}
+	return ipdisp.catchall, ipdisp.catchall != nil
+}
+
+//Aliases 返回配置目录为name的虚拟主机的别名
+func (ipdisp *IPDisp) Aliases(name string) []string {
+	if vhost, ok := ipdisp.vhosts[name]; ok {
+		return vhost.aliases
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package ipzone
+
+import "testing"
+
+func TestHostname(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"t.com", "t.com"},
+		{"T.Com", "t.com"},
+		{"t.com.", "t.com"},
+		{"t.com:8080", "t.com"},
+		{"T.COM.:80", "t.com"},
+		{"[2001:db8::1]:80", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"10.0.0.1:80", "10.0.0.1"},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if got := hostname(c.in); got != c.want {
+			t.Errorf("hostname(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
@@ -29,7 +29,7 @@ type Zone struct {
 // Node 节点信息
 type Node struct {
 	servers         []*Server
-	serverID        map[string]int
+	serverID        map[string]int //服务器IP在servers中的位置
 	curserver       *Server
 	servercount     int
 	balance         byte
@@ -40,23 +40,42 @@ type Node struct {
 	id              int
 	vhost           string
 	status          int
-	overflow2node   string
-	overflow2nodeid int
+	overflow2node   []string
+	overflowchain   []int //展开后的overflow节点链
+	overflowfinal   string
+	overflowfinalid int
 	swtree          *rbtree.Tree
 	sw              []int
 	reqlastmin      uint64 //上一分钟请求数
 	reqmin          uint64
 	reqcount        uint64 //分配到此节点的请求计数
+	shedratio       int    //切往overflow2node的流量比例，取值0-swMAX
+	shedcount       uint64 //切往overflow2node的请求计数
+	ovl             *overload
+	cdn             *CDN //不为nil时，节点为第三方CDN
+	geo             *geo
+	carriers        []string //节点服务的运营商
+	linefallback    string   //客户端的运营商没有对应地址时，使用此运营商的地址
+	basetarget      float64  //配置文件中的目标利用率，定时配置失效时恢复
+	maxqps          int      //节点的请求速率上限，0为不限
+	qpswin          *window
+	url             string //跳转地址模板
 }
 
 //Server 服务器信息
 type Server struct {
-	next      *Server
-	ip        string
-	weight    int
-	weightstr string
-	id        int
-	status    int
+	next       *Server
+	ip         string
+	weight     int
+	weightstr  string
+	id         int
+	status     int
+	lines      map[string]string //运营商对应的服务器地址
+	baseweight string            //配置文件中的权重，定时配置失效时恢复
+	maxqps     int               //服务器的请求速率上限，0为不限
+	qpswin     *window
+	port       int    //跳转地址中的端口，0为不指定
+	url        string //跳转地址模板
 }
 
 //ServerWeight 服务器权重信息
@@ -71,27 +90,74 @@ type ServerWeight struct {
 type Vhost struct {
 	id          int
 	name        string
-	zone2node   [1000]int
+	view        *view //当前使用的区域与节点的对应关系
+	baseview    *view //view.conf中配置的区域与节点的对应关系
+	schedules   []*schedule
+	schedule    *schedule //当前生效的定时配置
+	schedmin    int64     //上次检查定时配置的时间（分钟）
 	nodes       []*Node
 	nodeID      map[string]int
 	defaultNode int
 	reqcount    uint64
+	reqwin      *window
+	redirect    *redirect
+	aliases     []string //别名，可以是通配符域名
+	catchall    bool     //是否处理未配置域名的请求
+	failure     *Failure //调度失败时的处理方式，为nil时使用全局的处理方式
+}
+
+//view 区域与节点的对应关系，以区域ID为key。zone2node中没有的区域为未配置，调度到默认节点
+type view struct {
+	zone2node    map[int][]int //区域对应的有序节点列表，第一个为主节点，其余为后备节点
+	zoneweight   map[int][]int //区域在各节点间按权重分配时，zone2node中各节点的权重
+	zonefallback map[int][]int //区域的后备节点，包括配置的后备节点和按距离选择的节点
+}
+
+//newView 初始化区域与节点的对应关系
+func newView() *view {
+	v := &view{}
+	v.zone2node = make(map[int][]int)
+	v.zoneweight = make(map[int][]int)
+	v.zonefallback = make(map[int][]int)
+	return v
+}
+
+//Result 调度结果
+type Result struct {
+	IP       string //服务器IP，调度到第三方CDN时为空
+	Zone     string //客户端IP所在区域
+	Node     string //调度到的节点
+	host     string
+	vhost    *Vhost
+	node     *Node
+	server   *Server
+	fallback []int //区域的后备节点
 }
 
 //IPDisp IP调度配置入口
 type IPDisp struct {
-	zoneID     map[string]int
+	zoneID     map[string]int //IP地址库中的区域
+	zoneReg    map[string]int //区域ID登记，包括IP地址库中已删除的区域
+	zoneNew    bool           //有新登记的区域，需要保存登记文件
 	zoneMax    int
-	vhosts     map[string]*Vhost
+	zonegeo    map[int]*geo
+	vhosts     map[string]*Vhost //以配置目录名为key
+	hosts      map[string]*Vhost //域名和别名
+	wildcards  map[string]*Vhost //通配符域名，key为去掉“*”的后缀，如.example.com
+	catchall   *Vhost            //处理未配置域名请求的虚拟主机
 	rbtree     *rbtree.Tree
 	mutex      sync.Mutex
 	reqcount   uint64
 	othercount uint64
+	failcount  map[string]uint64 //按原因统计的调度失败请求数
+	overrides  []override        //通过Set修改的设置，重新加载配置时保留
 }
 
 const (
 	//swMAX 设置权重最大值
 	swMAX = 10000
+	//qpsWindow 统计请求速率的时间窗口
+	qpsWindow = time.Second
 )
 
 var serverstat = map[string]int{"up": 0, "down": 2, "backup": 4}
@@ -100,7 +166,10 @@ var serverstat = map[string]int{"up": 0, "down": 2, "backup": 4}
 func New() *IPDisp {
 	ipdisp := &IPDisp{}
 	ipdisp.zoneID = make(map[string]int)
+	ipdisp.zoneReg = make(map[string]int)
+	ipdisp.zoneMax = 1
 	ipdisp.vhosts = make(map[string]*Vhost)
+	ipdisp.failcount = make(map[string]uint64)
 	ipdisp.reqcount = 0
 	ipdisp.othercount = 0
 	return ipdisp
@@ -111,13 +180,14 @@ func (zone *Zone) Name() (name string) {
 	return zone.name
 }
 
-//GetCount 获取统计信息
-func (ipdisp *IPDisp) GetCount(host string, node string, last string) (count uint64) {
+//GetCount 获取统计信息。item为shed时返回节点切流量的请求数，为shedratio时返回切流量比例（万分比）。
+//node为fail时返回item原因（host、ip或node）调度失败的请求数
+func (ipdisp *IPDisp) GetCount(host string, node string, last string, item string) (count uint64) {
 	count = 0
 	//fmt.Printf("IPDispF: %v\n", *ipdisp)
 	switch node {
 	case "none":
-		vhost, ok := ipdisp.vhosts[host]
+		vhost, ok := ipdisp.lookup(host)
 		if ok == true {
 			count = vhost.reqcount
 		}
@@ -125,15 +195,22 @@ func (ipdisp *IPDisp) GetCount(host string, node string, last string) (count uin
 		count = ipdisp.reqcount
 	case "other":
 		count = ipdisp.othercount
+	case "fail":
+		count = ipdisp.failcount[item]
 	default:
-		vhost, ok := ipdisp.vhosts[host]
+		vhost, ok := ipdisp.lookup(host)
 		if ok == true {
 			nid, ok1 := vhost.nodeID[node]
 			if ok1 == true {
 				//fmt.Printf("%v\n", vhost.nodes[nid].swtree.String())
-				if last != "" {
+				switch {
+				case item == "shed":
+					count = vhost.nodes[nid].shedcount
+				case item == "shedratio":
+					count = uint64(vhost.nodes[nid].shedratio)
+				case last != "":
 					count = vhost.nodes[nid].reqlastmin
-				} else {
+				default:
 					count = vhost.nodes[nid].reqcount
 				}
 			}
@@ -146,11 +223,16 @@ func (ipdisp *IPDisp) GetCount(host string, node string, last string) (count uin
 func (ipdisp *IPDisp) Set(host string, object string, values []string) (err error) {
 	ipdisp.mutex.Lock()
 	defer ipdisp.mutex.Unlock()
-	vhost, ok := ipdisp.vhosts[host]
+	vhost, ok := ipdisp.lookup(host)
 	if ok != true {
 		err = errors.New("Not found " + host)
 		return
 	}
+	defer func() {
+		if err == nil {
+			ipdisp.record(vhost.name, object, values)
+		}
+	}()
 	err = errors.New("Value is invalid")
 	switch object {
 	case "node":
@@ -160,7 +242,10 @@ func (ipdisp *IPDisp) Set(host string, object string, values []string) (err erro
 				return
 			}
 			// node key value
-			nid := vhost.nodeID[items[0]]
+			nid, ok := vhost.nodeID[items[0]]
+			if ok == false {
+				return errors.New("not valid node: " + items[0])
+			}
 			node := vhost.nodes[nid]
 			switch items[1] {
 			case "bw":
@@ -177,19 +262,51 @@ func (ipdisp *IPDisp) Set(host string, object string, values []string) (err erro
 				node.status = status
 			}
 		}
+	case "zone":
+		for _, v := range values {
+			//zone:node:weight
+			items := strings.Split(v, ":")
+			if len(items) != 3 {
+				return
+			}
+			zid, ok := ipdisp.zoneID[items[0]]
+			if ok == false {
+				return
+			}
+			nid, ok := vhost.nodeID[items[1]]
+			if ok == false {
+				return
+			}
+			w, ok1 := strconv.Atoi(items[2])
+			if ok1 != nil || w < 0 {
+				return
+			}
+			//默认配置和定时配置的view都修改，切换定时配置后仍然生效
+			for _, vw := range vhost.views() {
+				vw.setweight(zid, nid, w, vhost.defaultNode)
+			}
+		}
+		for _, vw := range vhost.views() {
+			ipdisp.initfallback(vhost, vw)
+		}
 	case "server":
+		//同一节点的多个服务器权重一起生效，只有相加等于100时才替换
+		weights := make(map[*Node]map[*Server]string)
 		for _, v := range values {
 			items := strings.Split(v, ":")
 			if len(items) != 4 {
 				return
 			}
-			nid := vhost.nodeID[items[0]]
-			node := vhost.nodes[nid]
-			sid := node.serverID[items[1]]
-			svr := node.servers[sid]
+			node, svr, e := vhost.server(items[0], items[1])
+			if e != nil {
+				return e
+			}
 			switch items[2] {
 			case "weight":
-				svr.weightstr = items[3]
+				if weights[node] == nil {
+					weights[node] = make(map[*Server]string)
+				}
+				weights[node][svr] = items[3]
 			case "status":
 				status, ok := serverstat[items[3]]
 				if ok == false {
@@ -198,6 +315,17 @@ func (ipdisp *IPDisp) Set(host string, object string, values []string) (err erro
 				svr.status = status
 			}
 		}
+		for node, ws := range weights {
+			if e := node.checkweights(node.overlay(ws)); e != nil {
+				return errors.New(node.name + ": " + e.Error())
+			}
+		}
+		for node, ws := range weights {
+			node.resetbalance(ws)
+			for svr, w := range ws {
+				svr.baseweight = w
+			}
+		}
 	}
 
 	return nil
@@ -306,11 +434,16 @@ func (ipdisp *IPDisp) LoadNode(conf string, vhostname string) (err error) {
 
 	ipdisp.vhosts[vhostname] = &Vhost{}
 	vhost := ipdisp.vhosts[vhostname]
+	vhost.name = vhostname
 	vhost.nodeID = make(map[string]int)
 	vhost.defaultNode = 0
 	vhost.reqcount = 0
+	vhost.reqwin = newWindow(cdnWindow)
+	vhost.redirect = newRedirect()
 	nodeid := -1
 	var cnode *Node
+	var csched *schedule
+	cconf := false
 	for _, fline := range flines {
 		flen := len(fline)
 		if flen < 3 || fline[0] == '#' {
@@ -322,7 +455,23 @@ func (ipdisp *IPDisp) LoadNode(conf string, vhostname string) (err error) {
 			//	cnode.servers[cnode.servercount-1].next = cnode.servers[0]
 			//}
 			nodename := string(fline[1 : flen-1])
+			cnode = nil
+			csched = nil
+			cconf = false
+			switch {
+			case nodename == "conf":
+				cconf = true
+				continue
+			case strings.HasPrefix(nodename, "schedule:"):
+				csched = newSchedule(nodename[9:])
+				vhost.schedules = append(vhost.schedules, csched)
+				continue
+			}
 			cnode = &Node{}
+			if strings.HasPrefix(nodename, "cdn:") {
+				nodename = nodename[4:]
+				cnode.cdn = newCDN()
+			}
 			cnode.name = nodename
 			cnode.status = 0
 			cnode.servercount = 0
@@ -332,6 +481,8 @@ func (ipdisp *IPDisp) LoadNode(conf string, vhostname string) (err error) {
 			cnode.reqlastmin = 0
 			cnode.reqcount = 0
 			cnode.freebw = 20
+			cnode.ovl = newOverload(time.Now)
+			cnode.qpswin = newWindow(qpsWindow)
 			cnode.sw = make([]int, swMAX)
 			cnode.serverID = make(map[string]int)
 			cnode.swtree = rbtree.NewWith(Comparator)
@@ -339,21 +490,61 @@ func (ipdisp *IPDisp) LoadNode(conf string, vhostname string) (err error) {
 			nodeid++
 			vhost.nodeID[nodename] = nodeid
 		} else {
-			if nodeid == -1 {
-				continue
-			}
 			cfline := string(fline)
-			cf := strings.Split(cfline, "=")
+			cf := strings.SplitN(cfline, "=", 2)
 			if len(cf) != 2 {
 				continue
 			}
+			if cconf {
+				if err = vhost.set(cf[0], cf[1]); err != nil {
+					err = errors.New("conf: " + err.Error())
+					return
+				}
+				continue
+			}
+			if csched != nil {
+				if err = csched.set(cf[0], cf[1]); err != nil {
+					err = errors.New(csched.name + ": " + err.Error())
+					return
+				}
+				continue
+			}
+			if cnode == nil {
+				continue
+			}
+			if cnode.cdn != nil {
+				var ok bool
+				if ok, err = cnode.cdn.set(cf[0], cf[1]); err != nil {
+					err = errors.New(cnode.name + ": " + cf[0] + " config is invalid")
+					return
+				}
+				if ok {
+					continue
+				}
+			}
 			switch cf[0] {
 			case "server":
 				server := &Server{}
 				server.status = 0
 				server.weight = 0
 				server.id = 0
-				sinfo := strings.Split(cf[1], " ")
+				server.qpswin = newWindow(qpsWindow)
+				//ip id weight status之后，可以有key=value形式的扩展配置
+				var sinfo []string
+				for _, item := range strings.Fields(cf[1]) {
+					if kv := strings.SplitN(item, "=", 2); len(kv) == 2 {
+						if err = server.set(kv[0], kv[1]); err != nil {
+							err = errors.New(cnode.name + ": " + err.Error())
+							return
+						}
+						continue
+					}
+					sinfo = append(sinfo, item)
+				}
+				if len(sinfo) == 0 {
+					err = errors.New(cnode.name + ": server config is invalid")
+					return
+				}
 				server.ip = sinfo[0]
 				sinfolen := len(sinfo)
 				switch sinfolen {
@@ -370,22 +561,43 @@ func (ipdisp *IPDisp) LoadNode(conf string, vhostname string) (err error) {
 				/*
 					swcount = swcount + server.weight
 				*/
+				server.baseweight = server.weightstr
 				cnode.servers = append(cnode.servers, server)
 				if cnode.servercount == 0 {
 					cnode.curserver = server
 				} else {
 					cnode.servers[cnode.servercount-1].next = server
 				}
-				cnode.serverID[server.ip] = server.id
+				cnode.serverID[server.ip] = cnode.servercount
 				cnode.servercount++
 			case "bw":
 				cnode.bw, err = strconv.Atoi(cf[1])
+			case "url":
+				cnode.url = cf[1]
+			case "maxqps":
+				cnode.maxqps, err = strconv.Atoi(cf[1])
 			case "maxbw":
 				cnode.maxbw, err = strconv.Atoi(cf[1])
 			case "freebw":
 				cnode.freebw, err = strconv.Atoi(cf[1])
+			case "target":
+				var target int
+				target, err = strconv.Atoi(cf[1])
+				cnode.ovl.target = float64(target) / 100
+			case "hysteresis":
+				var hyst int
+				hyst, err = strconv.Atoi(cf[1])
+				cnode.ovl.hyst = float64(hyst) / 100
 			case "overflow2node":
-				cnode.overflow2node = cf[1]
+				cnode.overflow2node = strings.Split(cf[1], ",")
+			case "linefallback":
+				cnode.linefallback = cf[1]
+			case "geo":
+				cnode.geo, err = parseGeo(cf[1])
+			case "carrier":
+				cnode.carriers = strings.Split(cf[1], ",")
+			case "overflowfinal":
+				cnode.overflowfinal = cf[1]
 			case "status":
 				cnode.status = serverstat[cf[1]]
 			case "default":
@@ -409,11 +621,19 @@ func (ipdisp *IPDisp) LoadNode(conf string, vhostname string) (err error) {
 			}
 		}
 	}
+	if vhost.redirect.mode == "manifest" && vhost.redirect.origin == "" {
+		return errors.New("conf: manifest mode without origin")
+	}
+	if vhost.redirect.token != nil && vhost.redirect.token.key.ID == "" {
+		return errors.New("conf: token without tokenkey")
+	}
+	if err = vhost.initoverflow(); err != nil {
+		return
+	}
 	for _, node := range vhost.nodes {
-		var ok bool
-		node.overflow2nodeid, ok = vhost.nodeID[node.overflow2node]
-		if ok == false {
-			node.overflow2nodeid = -1
+		node.basetarget = node.ovl.target
+		if node.cdn != nil {
+			continue
 		}
 		//使server数组中，server.next首尾相接
 		node.servers[node.servercount-1].next = node.servers[0]
@@ -421,39 +641,200 @@ func (ipdisp *IPDisp) LoadNode(conf string, vhostname string) (err error) {
 		if len(node.servers) == 1 {
 			node.balance = 'o'
 		}
-		err = node.initbalance()
+		if err = node.initbalance(node.weightstrs()); err != nil {
+			return errors.New(node.name + ": " + err.Error())
+		}
+	}
+
+	return
+}
+
+//initoverflow 检查overflow2node的配置，并将多级overflow展开为有序的节点链。
+//节点a的链为：a的overflow2node中的每个节点，及其各自展开的链。出现环时返回错误
+func (vhost *Vhost) initoverflow() (err error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(vhost.nodes))
+	var expand func(node *Node) error
+	expand = func(node *Node) error {
+		switch state[node.id] {
+		case visiting:
+			return errors.New(node.name + ": overflow2node has a cycle")
+		case visited:
+			return nil
+		}
+		state[node.id] = visiting
+		seen := make(map[int]bool)
+		node.overflowchain = nil
+		for _, name := range node.overflow2node {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			nid, ok := vhost.nodeID[name]
+			if ok == false {
+				return errors.New(node.name + ": not valid overflow2node: " + name)
+			}
+			next := vhost.nodes[nid]
+			if err := expand(next); err != nil {
+				return err
+			}
+			for _, id := range append([]int{nid}, next.overflowchain...) {
+				if seen[id] == false {
+					seen[id] = true
+					node.overflowchain = append(node.overflowchain, id)
+				}
+			}
+		}
+		state[node.id] = visited
+		return nil
+	}
+	for _, node := range vhost.nodes {
+		if err = expand(node); err != nil {
+			return
+		}
+		node.overflowfinalid = -1
+		if node.overflowfinal != "" {
+			nid, ok := vhost.nodeID[node.overflowfinal]
+			if ok == false {
+				return errors.New(node.name + ": not valid overflowfinal: " + node.overflowfinal)
+			}
+			node.overflowfinalid = nid
+		}
+	}
+	return
+}
+
+//balance 服务器权重的分配表
+type balance struct {
+	swtree    *rbtree.Tree
+	sw        []int
+	weights   []int //各服务器的权重（万分制），与node.servers对应
+	curserver *Server
+}
+
+//server 按节点名称和服务器IP查找服务器
+func (vhost *Vhost) server(nodename string, ip string) (node *Node, svr *Server, err error) {
+	nid, ok := vhost.nodeID[nodename]
+	if ok == false {
+		err = errors.New("not valid node: " + nodename)
+		return
+	}
+	node = vhost.nodes[nid]
+	sid, ok := node.serverID[ip]
+	if ok == false {
+		err = errors.New("not valid server: " + ip)
+		return
+	}
+	svr = node.servers[sid]
+	return
+}
+
+//weightstrs 返回各服务器当前的权重配置
+func (node *Node) weightstrs() []string {
+	strs := make([]string, len(node.servers))
+	for i, svr := range node.servers {
+		strs[i] = svr.weightstr
+	}
+	return strs
+}
+
+//resetbalance 以新的服务器权重重新计算权重分配，weights中没有的服务器权重不变。
+//新的权重无效时返回错误，节点原来的权重和分配方式不变
+func (node *Node) resetbalance(weights map[*Server]string) error {
+	return node.initbalance(node.overlay(weights))
+}
+
+//overlay 返回以weights替换后各服务器的权重
+func (node *Node) overlay(weights map[*Server]string) []string {
+	strs := node.weightstrs()
+	for i, svr := range node.servers {
+		if w, ok := weights[svr]; ok {
+			strs[i] = w
+		}
 	}
+	return strs
+}
 
+//initbalance 根据服务器的权重计算权重分配方式，计算成功后才替换节点的权重和分配表
+func (node *Node) initbalance(weightstrs []string) (err error) {
+	var bl *balance
+	if bl, err = node.buildbalance(weightstrs); err != nil {
+		return
+	}
+	node.swtree = bl.swtree
+	node.sw = bl.sw
+	node.curserver = bl.curserver
+	for i, svr := range node.servers {
+		svr.weight = bl.weights[i]
+		svr.weightstr = weightstrs[i]
+	}
 	return
 }
 
-//initbalance 根据服务器配置信息，计算权重分配方式
-func (node *Node) initbalance() (err error) {
+//checkweights 检查服务器的权重是否有效，不改变节点
+func (node *Node) checkweights(weightstrs []string) error {
+	_, err := node.buildbalance(weightstrs)
+	return err
+}
+
+//buildbalance 根据服务器的权重计算权重分配表。随机数调度（A、a）的权重为百分制，相加等于100
+func (node *Node) buildbalance(weightstrs []string) (bl *balance, err error) {
+	bl = &balance{}
+	bl.swtree = rbtree.NewWith(Comparator)
+	bl.sw = make([]int, swMAX)
+	bl.weights = make([]int, len(node.servers))
+	bl.curserver = node.curserver
+	index := make(map[*Server]int)
+	for i, svr := range node.servers {
+		index[svr] = i
+	}
+	var ws []int
+	if node.balance == 'A' || node.balance == 'a' {
+		total := 0
+		ws = make([]int, len(node.servers))
+		for i := range node.servers {
+			if ws[i], err = strconv.Atoi(weightstrs[i]); err != nil || ws[i] < 0 {
+				return nil, errors.New("not valid weight: " + weightstrs[i])
+			}
+			total += ws[i]
+		}
+		if total != 100 {
+			return nil, errors.New("Total weight is not 100: " + strconv.Itoa(total))
+		}
+	}
 	switch node.balance {
 	case 'h':
 		k := 0
 		swcount := 0
 		swarray := make([]float64, swMAX)
 		swmap := make(map[uint32]int)
-		for id, svr := range node.servers {
-			for _, swrange := range strings.Split(svr.weightstr, ",") {
+		for id := range node.servers {
+			for _, swrange := range strings.Split(weightstrs[id], ",") {
 				swr := strings.Split(swrange, "-")
 				swrLen := len(swr)
 				swmin := k + 1
-				swmax, _ := strconv.Atoi(swr[0])
+				swmax, err := strconv.Atoi(swr[0])
+				if err != nil {
+					return nil, errors.New("not valid weight: " + weightstrs[id])
+				}
 				swmax = swmax*100 + k
 				if swrLen == 2 {
 					swmin = swmax
-					swmax, _ = strconv.Atoi(swr[1])
+					if swmax, err = strconv.Atoi(swr[1]); err != nil {
+						return nil, errors.New("not valid weight: " + weightstrs[id])
+					}
 					swmax = swmax * 100
 				}
 				for i := swmin; i <= swmax; i++ {
 					hash := Chash(uint32((id+1)*256*32 + (i+1)*563217))
 					if swcount > swMAX {
-						fmt.Fprintf(os.Stderr, node.name+": the total weight too max.")
-						break
+						return nil, errors.New("the total weight too max")
 					}
-					svr.weight++
+					bl.weights[id]++
 					swarray[i-1] = float64(hash)
 					swmap[hash] = id
 					swcount++
@@ -462,8 +843,7 @@ func (node *Node) initbalance() (err error) {
 			}
 		}
 		if swcount != swMAX {
-			err = errors.New("Total weight is not swmax: " + string(swcount))
-			return
+			return nil, errors.New("Total weight is not swmax: " + strconv.Itoa(swcount))
 		}
 		sort.Float64s(swarray)
 		var kk uint32
@@ -476,22 +856,21 @@ func (node *Node) initbalance() (err error) {
 			sid := swmap[fv]
 			swnode.server = node.servers[sid]
 			//fmt.Printf("Hash: %v %v %v\n", kk, fv, swnode.server.ip)
-			node.swtree.Put(swnode)
+			bl.swtree.Put(swnode)
 			kk = fv + 1
 		}
 
 	case 'A':
 
-		for id, svr := range node.servers {
-			w, _ := strconv.Atoi(svr.weightstr)
-			svr.weight = w * 100
-			for i := 0; i < svr.weight; i++ {
+		for id := range node.servers {
+			bl.weights[id] = ws[id] * 100
+			for i := 0; i < bl.weights[id]; i++ {
 				r := rand.New(rand.NewSource(time.Now().UnixNano()))
 				rn := r.Intn(swMAX)
-				for node.sw[rn] > 0 {
+				for bl.sw[rn] > 0 {
 					rn = r.Intn(swMAX)
 				}
-				node.sw[rn] = id
+				bl.sw[rn] = id
 			}
 		}
 	case 'a':
@@ -505,12 +884,12 @@ func (node *Node) initbalance() (err error) {
 			sgn := int(i / (node.servercount * 3))
 			sg := i % (node.servercount * 3)
 			sid := int(sg / 3)
-			ssw := node.servers[sid].weight
+			ssw := bl.weights[sid]
 			if ssw <= swnum[sid] || swnum[sid] >= tt {
 				continue
 			}
 			swnum[sid]++
-			node.sw[i] = sid
+			bl.sw[i] = sid
 			if ssw < tt {
 				cc := tt - ssw
 				switch {
@@ -533,7 +912,7 @@ func (node *Node) initbalance() (err error) {
 			sg := i % (node.servercount * 3)
 			sgn := int(i / (node.servercount * 3))
 			sid := int(sg / 3)
-			ssw := node.servers[sid].weight
+			ssw := bl.weights[sid]
 			if ssw < tt {
 				cc := tt - ssw
 
@@ -549,49 +928,142 @@ func (node *Node) initbalance() (err error) {
 				}
 			BLSW:
 				for {
-					if node.curserver.weight > tt && node.curserver.weight > swnum[node.curserver.id] {
-						sid = node.curserver.id
-						node.curserver = node.curserver.next
+					if cw := bl.weights[index[bl.curserver]]; cw > tt && cw > swnum[bl.curserver.id] {
+						sid = bl.curserver.id
+						bl.curserver = bl.curserver.next
 						break
 					}
-					node.curserver = node.curserver.next
+					bl.curserver = bl.curserver.next
 				}
-				node.sw[i] = sid
+				bl.sw[i] = sid
 				swnum[sid]++
 			}
 		}
 	}
-	return nil
+	return bl, nil
 }
 
 //LoadView 加载每个host的view配置
 func (ipdisp *IPDisp) LoadView(conf string, vhostname string) (err error) {
+	vhost := ipdisp.vhosts[vhostname]
+	var v *view
+	v, err = ipdisp.parseview(conf, vhost)
+	if v != nil {
+		vhost.view = v
+		vhost.baseview = v
+	}
+	return
+}
+
+//parseview 读取view配置文件
+func (ipdisp *IPDisp) parseview(conf string, vhost *Vhost) (v *view, err error) {
 	var flines []string
 	flines, err = file2string(conf)
 	if err != nil {
 		return
 	}
-	vhost := ipdisp.vhosts[vhostname]
+	v = newView()
 	for _, fline := range flines {
 		sline := strings.Split(fline, ";")
 		if len(sline) != 2 {
 			continue
 		}
 		v1, ok1 := ipdisp.zoneID[sline[0]]
-		v2, ok2 := vhost.nodeID[sline[1]]
-		if ok1 {
-			if ok2 {
-				vhost.zone2node[v1] = v2
-			} else {
-				err = errors.New(conf + " not valid node: " + sline[1])
-			}
-		} else {
+		if ok1 == false {
 			err = errors.New(conf + " not valid zone: " + sline[0])
+			continue
+		}
+		var nodes, weights []int
+		weighted := false
+		for _, nodename := range strings.Split(sline[1], ",") {
+			//node或node:weight
+			nw := strings.SplitN(strings.TrimSpace(nodename), ":", 2)
+			v2, ok2 := vhost.nodeID[nw[0]]
+			if ok2 == false {
+				err = errors.New(conf + " not valid node: " + nodename)
+				return
+			}
+			w := 0
+			if len(nw) == 2 {
+				if w, err = strconv.Atoi(nw[1]); err != nil || w < 0 {
+					err = errors.New(conf + " not valid weight: " + nodename)
+					return
+				}
+				weighted = true
+			}
+			nodes = append(nodes, v2)
+			weights = append(weights, w)
+		}
+		v.zone2node[v1] = nodes
+		delete(v.zoneweight, v1)
+		if weighted {
+			v.zoneweight[v1] = weights
 		}
 	}
 	return
 }
 
+//views 返回默认配置和定时配置的view
+func (vhost *Vhost) views() []*view {
+	views := []*view{vhost.baseview}
+	for _, sch := range vhost.schedules {
+		if sch.view != nil {
+			views = append(views, sch.view)
+		}
+	}
+	return views
+}
+
+//setweight 设置区域分配到节点的权重，节点不在区域的节点列表中时，加到列表末尾
+func (v *view) setweight(zid int, nid int, w int, defaultNode int) {
+	route, ok := v.zone2node[zid]
+	if ok == false {
+		route = []int{defaultNode}
+	}
+	weights := v.zoneweight[zid]
+	if weights == nil {
+		//原来没有按权重分配时，主节点承担全部流量
+		weights = make([]int, len(route))
+		weights[0] = 100
+	}
+	i := 0
+	for i < len(route) && route[i] != nid {
+		i++
+	}
+	if i == len(route) {
+		route = append(route, nid)
+		weights = append(weights, 0)
+	}
+	weights[i] = w
+	v.zone2node[zid] = route
+	v.zoneweight[zid] = weights
+}
+
+//primary 返回区域的主节点。区域按权重分配到多个节点时，以客户端IP的哈希值选择，同一客户端始终落在同一节点
+func (vhost *Vhost) primary(zid int, ip uint32) int {
+	route, ok := vhost.view.zone2node[zid]
+	if ok == false {
+		//未配置的区域，调度到默认节点
+		return vhost.defaultNode
+	}
+	weights := vhost.view.zoneweight[zid]
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	if total == 0 {
+		return route[0]
+	}
+	k := int(Chash(ip) % uint32(total))
+	for i, w := range weights {
+		if k < w {
+			return route[i]
+		}
+		k -= w
+	}
+	return route[0]
+}
+
 //LoadZone 读取ip地址段，并保存到rbtree中
 func (ipdisp *IPDisp) LoadZone(conf string) (err error) {
 	ipdisp.rbtree = rbtree.NewWith(Comparator)
@@ -600,8 +1072,8 @@ func (ipdisp *IPDisp) LoadZone(conf string) (err error) {
 	if err != nil {
 		return
 	}
-	zoneids := ipdisp.zoneID
-	ipdisp.zoneMax = 1
+	zoneids := make(map[string]int)
+	ipdisp.zoneID = zoneids
 	for _, fline := range flines {
 		zone := Zone{}
 		ipinfo := strings.Split(fline, ";")
@@ -623,9 +1095,8 @@ func (ipdisp *IPDisp) LoadZone(conf string) (err error) {
 		if v, ok := zoneids[zone.name]; ok == true {
 			zone.id = v
 		} else {
-			zoneids[zone.name] = ipdisp.zoneMax
-			zone.id = ipdisp.zoneMax
-			ipdisp.zoneMax++
+			zone.id = ipdisp.zoneid(zone.name)
+			zoneids[zone.name] = zone.id
 		}
 		ipdisp.rbtree.Put(zone)
 		//fmt.Printf("%v  %v  %v\n",ipzone.ipmin,ipzone.ipmax,ipzone.Zone)
@@ -635,11 +1106,19 @@ func (ipdisp *IPDisp) LoadZone(conf string) (err error) {
 
 //Init 读取配置文件，并加载到IPDisp
 func (ipdisp *IPDisp) Init(cfpath string) (err error) {
+	err = ipdisp.LoadZoneID(cfpath + "/zoneid")
+	if err != nil {
+		return
+	}
 	err = ipdisp.LoadZone(cfpath + "/ipz")
 	if err != nil {
 		fmt.Printf("error: %v\n", err)
 		return
 	}
+	err = ipdisp.LoadGeo(cfpath + "/geo")
+	if err != nil {
+		return
+	}
 	var dirs []os.FileInfo
 	dirs, err = ioutil.ReadDir(cfpath)
 	if err != nil {
@@ -656,9 +1135,14 @@ func (ipdisp *IPDisp) Init(cfpath string) (err error) {
 			if err != nil {
 				return err
 			}
+			ipdisp.initfallback(ipdisp.vhosts[dir.Name()], ipdisp.vhosts[dir.Name()].view)
+			err = ipdisp.initschedule(ipdisp.vhosts[dir.Name()], cfpath+"/"+dir.Name())
+			if err != nil {
+				return err
+			}
 		}
 	}
-	return nil
+	return ipdisp.inithosts()
 }
 
 //Chash 一致性哈希算法
@@ -694,62 +1178,154 @@ func (ipdisp *IPDisp) QueryZone(clip string) string {
 }
 
 //Query 根据客户端IP，host，调度字符串（通常可以用url）计算调度目标
-func (ipdisp *IPDisp) Query(clip string, host string, hashstr string) (string, string, error) {
+func (ipdisp *IPDisp) Query(clip string, host string, hashstr string) (*Result, error) {
+	return ipdisp.query(clip, host, hashstr, nil)
+}
+
+//QueryHost 与Query相同，但只调度已配置的域名、别名和通配符域名，不使用catchall
+func (ipdisp *IPDisp) QueryHost(clip string, host string, hashstr string) (*Result, error) {
+	if _, ok := ipdisp.lookup(host); ok == false {
+		ipdisp.reqcount++
+		ipdisp.othercount++
+		return nil, ipdisp.fail(FailHost, "Not found "+host)
+	}
+	return ipdisp.query(clip, host, hashstr, nil)
+}
+
+//query 计算调度目标。tr不为nil时为模拟调度：记录每一步，不计入请求统计，也不改变轮询的位置
+func (ipdisp *IPDisp) query(clip string, host string, hashstr string, tr *Trace) (*Result, error) {
 	//fmt.Printf("IPDisp: %v\n", *ipdisp)
-	ipdisp.reqcount++
-	var err error
-	vhost, ok := ipdisp.vhosts[host]
+	dry := tr != nil
+	if dry == false {
+		ipdisp.reqcount++
+	}
+	vhost, ok := ipdisp.match(host)
 	if ok != true {
+		if dry {
+			return nil, &QueryError{Reason: FailHost, msg: "Not found " + host}
+		}
 		ipdisp.othercount++
-		err = errors.New("Not found " + host)
-		return "", "", err
+		return nil, ipdisp.fail(FailHost, "Not found "+host)
+	}
+	tr.add("host", "%s matched vhost %s", hostname(host), vhost.name)
+	if tr != nil {
+		tr.Vhost = vhost.name
+	}
+	now := time.Now()
+	if dry == false {
+		vhost.reqcount++
+		vhost.reqwin.add(now)
+		vhost.checkschedule(now)
+	}
+	if tr != nil && vhost.schedule != nil {
+		tr.Schedule = vhost.schedule.name
+		tr.add("schedule", "schedule %s is active", vhost.schedule.name)
 	}
-	vhost.reqcount++
 	var node *Node
 	zonename := "None"
 	nodeid := vhost.defaultNode
 	ip := InetNetwork(clip)
 	if ip == 0 {
-		err = errors.New("Not valid ip: " + clip)
-		return "", "", err
+		if dry {
+			return nil, &QueryError{Reason: FailIP, msg: "Not valid ip: " + clip}
+		}
+		return nil, ipdisp.fail(FailIP, "Not valid ip: "+clip)
 	}
-	node = vhost.nodes[nodeid]
+	var fallback []int
 	//查找IP所属区域
 	rbnode, ok := ipdisp.rbtree.Get(ip)
 	if ok == true {
 		ipz := rbnode.(Zone)
 		zonename = ipz.name
-		nodeid = vhost.zone2node[ipz.id]
-		node = vhost.nodes[nodeid]
+		nodeid = vhost.primary(ipz.id, ip)
+		fallback = vhost.view.zonefallback[ipz.id]
+		if tr != nil {
+			tr.Range = inetString(ipz.ipmin) + "-" + inetString(ipz.ipmax)
+			tr.add("zone", "%s in zone %s (id %d, range %s)", clip, zonename, ipz.id, tr.Range)
+			if route, ok := vhost.view.zone2node[ipz.id]; ok {
+				tr.add("view", "zone routes to %s, weights %v, client hash %d, fallback %s",
+					vhost.nodenames(route), vhost.view.zoneweight[ipz.id], Chash(ip), vhost.nodenames(fallback))
+			} else {
+				tr.add("view", "zone is not in view, using default node")
+			}
+		}
+	} else {
+		tr.add("zone", "%s not found in ip library, using default node", clip)
 	}
-	//如果节点的状态为down，以overflow节点替换，如果没有overflow节点，查找其他可用节点替换
+	node = vhost.nodes[nodeid]
+	tr.add("node", "mapped to node %s", node.name)
+	//如果节点的状态为down，依次以overflow节点、区域的后备节点替换；都没有配置时，按配置顺序使用下一个状态为up的节点
 	if node.status != 0 {
-		if node.overflow2nodeid == -1 {
-			for node.status != 0 {
-				nid := node.id + 1
-				node = vhost.nodes[nid]
-			}
+		tr.add("status", "node %s is down", node.name)
+		if len(node.overflowchain) == 0 && node.overflowfinalid < 0 && len(fallback) == 0 {
+			node = vhost.nextup(node, tr)
 		} else {
-			node = vhost.nodes[node.overflow2nodeid]
+			node = vhost.overflow(node, fallback, tr)
+		}
+		if node == nil {
+			if dry {
+				return nil, &QueryError{Reason: FailNode, msg: "No available node for " + host}
+			}
+			return nil, ipdisp.fail(FailNode, "No available node for "+host)
+		}
+	}
+	//由过载控制器判断节点负载，超过目标利用率时，按比例向overflow节点、区域的后备节点切流量
+	if len(node.overflowchain) > 0 || node.overflowfinalid >= 0 || len(fallback) > 0 {
+		shedratio := node.shed(dry)
+		key := int(node.shedkey(ip, hashstr) % swMAX)
+		tr.add("overload", "node %s shed ratio %d/%d, shed key %d", node.name, shedratio, swMAX, key)
+		if shedratio > 0 && key < shedratio {
+			if next := vhost.overflow(node, fallback, tr); next != nil {
+				if dry == false {
+					node.shedcount++
+					node.ovl.drop()
+				}
+				node = next
+			}
+		}
+	}
+	//节点超过请求速率上限时，超出的请求切往overflow节点、区域的后备节点
+	if node.qpsfull(now) {
+		tr.add("qps", "node %s reached maxqps %d", node.name, node.maxqps)
+		if next := vhost.overflow(node, fallback, tr); next != nil {
+			if dry == false {
+				node.shedcount++
+				node.ovl.drop()
+			}
+			node = next
+		}
+	}
+	res := &Result{Zone: zonename, Node: node.name, host: hostname(host), vhost: vhost, node: node, fallback: fallback}
+	if dry == false {
+		curtime := time.Now().Unix()
+		//unixtime := curtime.Unix()
+		if curtime%60 == 0 {
+			node.reqlastmin = node.reqmin
+			node.reqmin = 0
 		}
+		node.reqcount++
+		node.reqmin++
+		node.ovl.admit()
+		node.qpswin.add(now)
 	}
-	//判断节点带宽使用，超过阈值，向overflow2node切流量
-	if node.maxbw-node.bw >= node.freebw && node.reqmin > node.reqlastmin && node.overflow2nodeid >= 0 {
-		node = vhost.nodes[node.overflow2nodeid]
+	if node.cdn != nil {
+		tr.add("cdn", "node %s is third-party CDN %s", node.name, node.cdn.host)
+		if dry == false {
+			node.cdn.reqwin.add(now)
+		}
+		return res, nil
 	}
-	curtime := time.Now().Unix()
-	//unixtime := curtime.Unix()
-	if curtime%60 == 0 {
-		node.reqlastmin = node.reqmin
-		node.reqmin = 0
+	if tr != nil {
+		tr.Balance = balanceName(node.balance)
+		tr.Hash = HashStr(hashstr)
+		tr.add("balance", "node %s balance %s, hash of %q is %d", node.name, tr.Balance, hashstr, tr.Hash)
 	}
-	node.reqcount++
-	node.reqmin++
 	var curserver *Server
 	//根据节点负载均衡的方式，选择server。
 	switch node.balance {
 	case 'o':
-		return node.curserver.ip, zonename, nil
+		//只有一台服务器，不检查服务器状态，同样计入服务器的请求速率
+		curserver = node.curserver
 	case 'a':
 		sid := int(HashStr(hashstr)) % (swMAX - 1)
 		curserver = node.servers[node.sw[sid]]
@@ -763,15 +1339,191 @@ func (ipdisp *IPDisp) Query(clip string, host string, hashstr string) (string, s
 			swnode := rbnode.(ServerWeight)
 			curserver = swnode.server
 		} else {
-			curserver = getnextsvr(node)
+			curserver = node.nextserver(dry)
 		}
 	case 'r':
-		curserver = getnextsvr(node)
+		curserver = node.nextserver(dry)
+	}
+	tr.add("server", "balance selected server %s (id %d)", curserver.ip, curserver.id)
+	if curserver.status != 0 && node.balance != 'o' {
+		tr.add("server", "skip server %s: down", curserver.ip)
+		curserver = node.nextserver(dry)
+	}
+	if tr != nil {
+		for next := curserver; ; next = next.next {
+			state := serverState(next, now)
+			if state == "" || next.next == curserver {
+				break
+			}
+			tr.add("server", "skip server %s: %s", next.ip, state)
+		}
+	}
+	curserver = node.spill(curserver, now)
+	if dry == false {
+		curserver.qpswin.add(now)
+	}
+	res.server = curserver
+	res.IP = curserver.addr(zoneCarrier(zonename), node.linefallback)
+	tr.add("server", "chosen server %s (id %d), address %s", curserver.ip, curserver.id, res.IP)
+	return res, nil
+}
+
+//nextserver 轮询选择下一台状态为up的服务器，dry为true时不改变轮询的位置
+func (node *Node) nextserver(dry bool) *Server {
+	if dry {
+		return node.upserver()
+	}
+	return getnextsvr(node)
+}
+
+//nodenames 返回节点ID列表对应的节点名称
+func (vhost *Vhost) nodenames(nids []int) []string {
+	names := make([]string, 0, len(nids))
+	for _, nid := range nids {
+		names = append(names, vhost.nodes[nid].name)
+	}
+	return names
+}
+
+//inetString 将整数形式的IPv4地址转为字符串
+func inetString(ip uint32) string {
+	return net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)).String()
+}
+
+//overflow 依次在节点的overflow链、区域的后备节点中查找状态为up且未过载的节点。
+//都不可用时使用overflowfinal，其次使用状态为up的后备节点（不再要求未过载）。tr不为nil时记录跳过的节点
+func (vhost *Vhost) overflow(node *Node, fallback []int, tr *Trace) *Node {
+	for _, chain := range [][]int{node.overflowchain, fallback} {
+		for _, nid := range chain {
+			next := vhost.nodes[nid]
+			if next == node {
+				continue
+			}
+			switch {
+			case next.status != 0:
+				tr.add("overflow", "skip node %s: down", next.name)
+			case vhost.full(next, tr != nil):
+				tr.add("overflow", "skip node %s: full", next.name)
+			default:
+				tr.add("overflow", "node %s -> %s", node.name, next.name)
+				return next
+			}
+		}
+	}
+	if node.overflowfinalid >= 0 && vhost.nodes[node.overflowfinalid].status == 0 {
+		tr.add("overflow", "node %s -> overflowfinal %s", node.name, node.overflowfinal)
+		return vhost.nodes[node.overflowfinalid]
+	}
+	for _, nid := range fallback {
+		next := vhost.nodes[nid]
+		if next != node && next.status == 0 {
+			tr.add("overflow", "node %s -> %s (full)", node.name, next.name)
+			return next
+		}
+	}
+	tr.add("overflow", "no available node for %s", node.name)
+	return nil
+}
+
+//nextup 按配置顺序返回node之后第一个状态为up的节点（到末尾后从头开始），跳过第三方CDN节点，都不可用时返回nil
+func (vhost *Vhost) nextup(node *Node, tr *Trace) *Node {
+	for i := 1; i < len(vhost.nodes); i++ {
+		next := vhost.nodes[(node.id+i)%len(vhost.nodes)]
+		if next.status == 0 && next.cdn == nil {
+			tr.add("overflow", "node %s -> next up node %s", node.name, next.name)
+			return next
+		}
+	}
+	tr.add("overflow", "no available node for %s", node.name)
+	return nil
+}
+
+//full 节点是否过载，第三方CDN节点判断是否达到调度上限。dry为true时不更新过载控制器
+func (vhost *Vhost) full(node *Node, dry bool) bool {
+	if node.cdn != nil {
+		return node.cdn.full(node, vhost, time.Now())
+	}
+	if node.qpsfull(time.Now()) {
+		return true
+	}
+	node.shed(dry)
+	return node.ovl.active
+}
+
+//shed 更新过载控制器，返回需要切走的流量比例。dry为true时只返回上次计算的比例，不改变控制器的状态
+func (node *Node) shed(dry bool) int {
+	if dry {
+		return node.ovl.level()
+	}
+	node.shedratio = node.ovl.update(node.bw, node.maxbw, node.freebw)
+	return node.shedratio
+}
+
+//qpsfull 节点最近一秒的请求数是否达到上限
+func (node *Node) qpsfull(now time.Time) bool {
+	return node.maxqps > 0 && node.qpswin.count(now) >= float64(node.maxqps)
+}
+
+//qpsfull 服务器最近一秒的请求数是否达到上限
+func (svr *Server) qpsfull(now time.Time) bool {
+	return svr.maxqps > 0 && svr.qpswin.count(now) >= float64(svr.maxqps)
+}
+
+//spill 服务器达到请求速率上限时，依次选择同节点中状态为up且未达到上限的服务器，都达到上限时仍使用原服务器
+func (node *Node) spill(svr *Server, now time.Time) *Server {
+	if svr.qpsfull(now) == false {
+		return svr
+	}
+	for next := svr.next; next != svr; next = next.next {
+		if next.status == 0 && next.qpsfull(now) == false {
+			return next
+		}
+	}
+	return svr
+}
+
+//shedkey 计算切流量使用的key，保证同一用户（哈希调度时为同一调度字符串）始终落在同一侧
+func (node *Node) shedkey(ip uint32, hashstr string) uint32 {
+	if node.balance == 'h' {
+		return HashStr(hashstr)
+	}
+	return Chash(ip)
+}
+
+//set 设置server的扩展配置
+func (svr *Server) set(key string, value string) (err error) {
+	switch key {
+	case "qps":
+		svr.maxqps, err = strconv.Atoi(value)
+	case "port":
+		svr.port, err = strconv.Atoi(value)
+	case "url":
+		svr.url = value
+	case "line":
+		//line=cp1:ip1,cp2:ip2
+		svr.lines = make(map[string]string)
+		for _, line := range strings.Split(value, ",") {
+			cl := strings.SplitN(line, ":", 2)
+			if len(cl) != 2 || net.ParseIP(cl[1]) == nil {
+				return errors.New("not valid line: " + line)
+			}
+			svr.lines[cl[0]] = cl[1]
+		}
+	default:
+		err = errors.New("not valid server config: " + key)
+	}
+	return
+}
+
+//addr 返回客户端运营商对应的服务器地址。没有对应地址时，使用fallback运营商的地址，其次使用server的ip
+func (svr *Server) addr(carrier string, fallback string) string {
+	if ip, ok := svr.lines[carrier]; ok {
+		return ip
 	}
-	if curserver.status != 0 {
-		curserver = getnextsvr(node)
+	if ip, ok := svr.lines[fallback]; ok {
+		return ip
 	}
-	return curserver.ip, zonename, nil
+	return svr.ip
 }
 
 func getnextsvr(node *Node) *Server {
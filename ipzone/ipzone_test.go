@@ -0,0 +1,558 @@
+package ipzone
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dale-di/ipdispatch/urlsign"
+)
+
+//testIPZ 测试用的IP地址库
+const testIPZ = `1.0.0.0/8;zone1|cp1
+2.0.0.0/8;zone2|cp2
+3.0.0.0/8;zone3|cp3
+`
+
+//newTestDisp 在临时目录中写入配置并加载。files的key为相对配置目录的文件名，没有ipz时使用testIPZ
+func newTestDisp(t *testing.T, files map[string]string) *IPDisp {
+	t.Helper()
+	ipdisp, err := loadTestDisp(t, files)
+	if err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	return ipdisp
+}
+
+//loadTestDisp 与newTestDisp相同，返回加载配置的错误
+func loadTestDisp(t *testing.T, files map[string]string) (*IPDisp, error) {
+	t.Helper()
+	dir := t.TempDir()
+	if _, ok := files["ipz"]; ok == false {
+		files["ipz"] = testIPZ
+	}
+	for name, content := range files {
+		fname := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ipdisp := New()
+	return ipdisp, ipdisp.Init(dir)
+}
+
+func TestQueryDownNode(t *testing.T) {
+	cases := []struct {
+		name string
+		node string
+		view string
+		want string
+		fail string
+	}{
+		{
+			name: "next up node without overflow",
+			node: "[a]\nserver=10.0.0.1 0 100\nstatus=down\n[b]\nserver=10.0.0.2 0 100\n",
+			view: "zone1|cp1;a\n",
+			want: "b",
+		},
+		{
+			name: "wrap around to the first node",
+			node: "[a]\nserver=10.0.0.1 0 100\n[b]\nserver=10.0.0.2 0 100\nstatus=down\n",
+			view: "zone1|cp1;b\n",
+			want: "a",
+		},
+		{
+			name: "skip down nodes",
+			node: "[a]\nserver=10.0.0.1 0 100\nstatus=down\n[b]\nserver=10.0.0.2 0 100\nstatus=down\n[c]\nserver=10.0.0.3 0 100\n",
+			view: "zone1|cp1;a\n",
+			want: "c",
+		},
+		{
+			name: "all nodes down",
+			node: "[a]\nserver=10.0.0.1 0 100\nstatus=down\n[b]\nserver=10.0.0.2 0 100\nstatus=down\n",
+			view: "zone1|cp1;a\n",
+			fail: FailNode,
+		},
+		{
+			name: "configured fallback only",
+			node: "[a]\nserver=10.0.0.1 0 100\nstatus=down\n[b]\nserver=10.0.0.2 0 100\nstatus=down\n[c]\nserver=10.0.0.3 0 100\n",
+			view: "zone1|cp1;a,b\n",
+			fail: FailNode,
+		},
+	}
+	for _, c := range cases {
+		ipdisp := newTestDisp(t, map[string]string{"t.com/node.conf": c.node, "t.com/view.conf": c.view})
+		res, err := ipdisp.Query("1.2.3.4", "t.com", "/")
+		if c.fail != "" {
+			if Reason(err) != c.fail {
+				t.Errorf("%s: err = %v, want reason %s", c.name, err, c.fail)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if res.Node != c.want {
+			t.Errorf("%s: node = %s, want %s", c.name, res.Node, c.want)
+		}
+	}
+}
+
+func TestGeoFallback(t *testing.T) {
+	//zone1在(30,120)，near距离约150km，far距离约4000km
+	const nodes = "[a]\nserver=10.0.0.1 0 100\nstatus=down\n"
+	cases := []struct {
+		name string
+		node string
+		view string
+		geo  string
+		want string
+		fail string
+	}{
+		{
+			name: "nearest node",
+			node: nodes + "[far]\nserver=10.0.0.2 0 100\ngeo=40,80\n[near]\nserver=10.0.0.3 0 100\ngeo=31,121\n",
+			view: "zone1|cp1;a\n",
+			geo:  "zone1|cp1;30,120\n",
+			want: "near",
+		},
+		{
+			name: "region coordinates",
+			node: nodes + "[far]\nserver=10.0.0.2 0 100\ngeo=40,80\n[near]\nserver=10.0.0.3 0 100\ngeo=31,121\n",
+			view: "zone1|cp1;a\n",
+			geo:  "zone1;30,120\n",
+			want: "near",
+		},
+		{
+			name: "skip down nearest node",
+			node: nodes + "[far]\nserver=10.0.0.2 0 100\ngeo=40,80\n[near]\nserver=10.0.0.3 0 100\ngeo=31,121\nstatus=down\n",
+			view: "zone1|cp1;a\n",
+			geo:  "zone1|cp1;30,120\n",
+			want: "far",
+		},
+		{
+			name: "skip other carrier",
+			node: nodes + "[far]\nserver=10.0.0.2 0 100\ngeo=40,80\ncarrier=cp1\n[near]\nserver=10.0.0.3 0 100\ngeo=31,121\ncarrier=cp2,cp3\n",
+			view: "zone1|cp1;a\n",
+			geo:  "zone1|cp1;30,120\n",
+			want: "far",
+		},
+		{
+			name: "configured fallback first",
+			node: nodes + "[far]\nserver=10.0.0.2 0 100\ngeo=40,80\n[near]\nserver=10.0.0.3 0 100\ngeo=31,121\n",
+			view: "zone1|cp1;a,far\n",
+			geo:  "zone1|cp1;30,120\n",
+			want: "far",
+		},
+		{
+			name: "node without geo",
+			node: nodes + "[b]\nserver=10.0.0.2 0 100\n[far]\nserver=10.0.0.3 0 100\ngeo=40,80\n",
+			view: "zone1|cp1;a\n",
+			geo:  "zone1|cp1;30,120\n",
+			want: "far",
+		},
+		{
+			//没有后备节点时，按node.conf中的顺序选择
+			name: "no node for carrier",
+			node: nodes + "[near]\nserver=10.0.0.3 0 100\ngeo=31,121\ncarrier=cp2\n",
+			view: "zone1|cp1;a\n",
+			geo:  "zone1|cp1;30,120\n",
+			want: "near",
+		},
+		{
+			name: "configured and geo fallback down",
+			node: nodes + "[b]\nserver=10.0.0.2 0 100\nstatus=down\n[near]\nserver=10.0.0.3 0 100\ngeo=31,121\nstatus=down\n[c]\nserver=10.0.0.4 0 100\n",
+			view: "zone1|cp1;a,b\n",
+			geo:  "zone1|cp1;30,120\n",
+			fail: FailNode,
+		},
+	}
+	for _, c := range cases {
+		ipdisp := newTestDisp(t, map[string]string{"t.com/node.conf": c.node, "t.com/view.conf": c.view, "geo": c.geo})
+		res, err := ipdisp.Query("1.2.3.4", "t.com", "/")
+		if c.fail != "" {
+			if Reason(err) != c.fail {
+				t.Errorf("%s: err = %v, want reason %s", c.name, err, c.fail)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if res.Node != c.want {
+			t.Errorf("%s: node = %s, want %s", c.name, res.Node, c.want)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	ipdisp := newTestDisp(t, map[string]string{
+		"t.com/node.conf": "[a]\ndefault=yes\nserver=10.0.0.1 0 100\ngeo=30,120\n" +
+			"[far]\nserver=10.0.0.2 0 100\ngeo=40,80\ncarrier=cp1\n" +
+			"[near]\nserver=10.0.0.3 0 100\ngeo=31,121\n",
+		"t.com/view.conf": "zone1|cp1;a,far\nzone2|cp2;near\n",
+		"geo":             "zone1;30,120\nzone2|cp2;31,121\n",
+	})
+	km := func(from string, to string) string {
+		f, _ := parseGeo(from)
+		g, _ := parseGeo(to)
+		return fmt.Sprintf("%.0fkm", f.distance(g))
+	}
+	want := "[t.com]\n" +
+		"zone1|cp1;a,far(" + km("30,120", "40,80") + "),near(" + km("30,120", "31,121") + ")\n" +
+		"zone2|cp2;near,a(" + km("31,121", "30,120") + ")\n" +
+		"zone3|cp3;a(default)\n"
+	var b strings.Builder
+	ipdisp.Report(&b)
+	if b.String() != want {
+		t.Errorf("report:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestServerLine(t *testing.T) {
+	const lines = "line=cp1:10.1.0.1,cp2:10.2.0.1"
+	cases := []struct {
+		name string
+		node string
+		clip string
+		want string
+	}{
+		{name: "cp1", node: "[a]\nserver=10.0.0.1 0 100 up " + lines + "\n", clip: "1.2.3.4", want: "10.1.0.1"},
+		{name: "cp2", node: "[a]\nserver=10.0.0.1 0 100 up " + lines + "\n", clip: "2.2.3.4", want: "10.2.0.1"},
+		{name: "no line", node: "[a]\nserver=10.0.0.1 0 100 up " + lines + "\n", clip: "3.2.3.4", want: "10.0.0.1"},
+		{name: "linefallback", node: "[a]\nlinefallback=cp2\nserver=10.0.0.1 0 100 up " + lines + "\n", clip: "3.2.3.4", want: "10.2.0.1"},
+		{name: "linefallback without line", node: "[a]\nlinefallback=cp3\nserver=10.0.0.1 0 100 up " + lines + "\n", clip: "3.2.3.4", want: "10.0.0.1"},
+		{name: "own line before fallback", node: "[a]\nlinefallback=cp2\nserver=10.0.0.1 0 100 up " + lines + "\n", clip: "1.2.3.4", want: "10.1.0.1"},
+	}
+	for _, c := range cases {
+		ipdisp := newTestDisp(t, map[string]string{
+			"t.com/node.conf": c.node,
+			"t.com/view.conf": "zone1|cp1;a\nzone2|cp2;a\nzone3|cp3;a\n",
+		})
+		res, err := ipdisp.Query(c.clip, "t.com", "/")
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if res.IP != c.want {
+			t.Errorf("%s: ip = %s, want %s", c.name, res.IP, c.want)
+		}
+	}
+
+	//哈希调度按服务器选择，不同运营商的客户端调度到同一台服务器的不同地址
+	ipdisp := newTestDisp(t, map[string]string{
+		"t.com/node.conf": "[a]\nbalance=h\nserver=10.0.0.1 0 50 up line=cp1:10.1.0.1,cp2:10.2.0.1\n" +
+			"server=10.0.0.2 1 50 up line=cp1:10.1.0.2,cp2:10.2.0.2\n",
+		"t.com/view.conf": "zone1|cp1;a\nzone2|cp2;a\n",
+	})
+	for i := 0; i < 20; i++ {
+		path := "/video/" + strconv.Itoa(i) + ".mp4"
+		r1, err1 := ipdisp.Query("1.2.3.4", "t.com", path)
+		r2, err2 := ipdisp.Query("2.2.3.4", "t.com", path)
+		if err1 != nil || err2 != nil {
+			t.Fatalf("%s: %v %v", path, err1, err2)
+		}
+		id := r1.ServerID()
+		if r2.ServerID() != id || r1.IP != "10.1.0."+strconv.Itoa(id+1) || r2.IP != "10.2.0."+strconv.Itoa(id+1) {
+			t.Errorf("%s: cp1 %d %s, cp2 %d %s", path, r1.ServerID(), r1.IP, r2.ServerID(), r2.IP)
+		}
+	}
+}
+
+func TestZoneSplit(t *testing.T) {
+	ipdisp := newTestDisp(t, map[string]string{
+		"t.com/node.conf": "[a]\nserver=10.0.0.1 0 100\n[b]\nserver=10.0.0.2 0 100\n[c]\nserver=10.0.0.3 0 100\n",
+		"t.com/view.conf": "zone1|cp1;a:70,b:30\n",
+	})
+	//按客户端IP统计各节点的比例，同一客户端始终落在同一节点
+	split := func() map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 2000; i++ {
+			clip := fmt.Sprintf("1.%d.%d.%d", i%251, i*7%253, i*13%255)
+			res, err := ipdisp.Query(clip, "t.com", "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, _ := ipdisp.Query(clip, "t.com", "/")
+			if again.Node != res.Node {
+				t.Fatalf("%s: node %s then %s", clip, res.Node, again.Node)
+			}
+			counts[res.Node]++
+		}
+		return counts
+	}
+	near := func(n int, percent int) bool {
+		return n >= (percent-5)*20 && n <= (percent+5)*20
+	}
+	counts := split()
+	if near(counts["a"], 70) == false || near(counts["b"], 30) == false || counts["c"] != 0 {
+		t.Errorf("view split: %v, want a:70 b:30", counts)
+	}
+
+	//通过接口调整权重，加入新节点
+	if err := ipdisp.Set("t.com", "zone", []string{"zone1|cp1:a:20", "zone1|cp1:b:30", "zone1|cp1:c:50"}); err != nil {
+		t.Fatal(err)
+	}
+	counts = split()
+	if near(counts["a"], 20) == false || near(counts["b"], 30) == false || near(counts["c"], 50) == false {
+		t.Errorf("set split: %v, want a:20 b:30 c:50", counts)
+	}
+
+	for _, v := range []string{"zone1|cp1:a", "zone9|cp9:a:10", "zone1|cp1:x:10", "zone1|cp1:a:-1", "zone1|cp1:a:ten"} {
+		if err := ipdisp.Set("t.com", "zone", []string{v}); err == nil {
+			t.Errorf("set zone %s: no error", v)
+		}
+	}
+	counts = split()
+	if near(counts["a"], 20) == false || near(counts["c"], 50) == false {
+		t.Errorf("split changed by invalid values: %v", counts)
+	}
+}
+
+func TestSetServerWeight(t *testing.T) {
+	//服务器ID不是从0开始的连续数字
+	node := "[a]\nbalance=A\nserver=10.0.0.1 7 60\nserver=10.0.0.2 3 40\n"
+	cases := []struct {
+		name    string
+		weights []string
+		want    string
+		fail    bool
+	}{
+		{name: "valid weights", weights: []string{"a:10.0.0.1:weight:70", "a:10.0.0.2:weight:30"}, want: "70"},
+		{name: "not a number", weights: []string{"a:10.0.0.1:weight:x"}, want: "60", fail: true},
+		{name: "total not 100", weights: []string{"a:10.0.0.1:weight:80"}, want: "60", fail: true},
+		{name: "unknown server", weights: []string{"a:10.0.0.3:weight:100"}, want: "60", fail: true},
+		{name: "unknown node", weights: []string{"b:10.0.0.1:weight:100"}, want: "60", fail: true},
+		{name: "server status", weights: []string{"a:10.0.0.2:status:down"}, want: "60"},
+	}
+	for _, c := range cases {
+		ipdisp := newTestDisp(t, map[string]string{"t.com/node.conf": node, "t.com/view.conf": "zone1|cp1;a\n"})
+		err := ipdisp.Set("t.com", "server", c.weights)
+		if (err != nil) != c.fail {
+			t.Errorf("%s: err = %v", c.name, err)
+		}
+		svr := ipdisp.vhosts["t.com"].nodes[0].servers[0]
+		if svr.weightstr != c.want || svr.baseweight != c.want {
+			t.Errorf("%s: weight = %s/%s, want %s", c.name, svr.weightstr, svr.baseweight, c.want)
+		}
+		//权重无效时原来的分配表仍然可用
+		if _, err = ipdisp.Query("1.2.3.4", "t.com", "/"); err != nil {
+			t.Errorf("%s: query: %v", c.name, err)
+		}
+	}
+}
+
+func TestScheduleWeight(t *testing.T) {
+	cases := []struct {
+		name   string
+		weight string
+		fail   bool
+	}{
+		{name: "valid weight", weight: "weight=a:10.0.0.1:30\nweight=a:10.0.0.2:70"},
+		{name: "total not 100", weight: "weight=a:10.0.0.1:50", fail: true},
+		{name: "unknown server", weight: "weight=a:10.0.0.3:50", fail: true},
+		{name: "unknown node", weight: "weight=b:10.0.0.1:50", fail: true},
+	}
+	for _, c := range cases {
+		//服务器ID不是从0开始的连续数字
+		ipdisp, err := loadTestDisp(t, map[string]string{
+			"t.com/node.conf": "[a]\nbalance=A\nserver=10.0.0.1 7 60\nserver=10.0.0.2 3 40\n[schedule:night]\ntime=00:00-23:59\n" + c.weight + "\n",
+			"t.com/view.conf": "zone1|cp1;a\n",
+		})
+		if (err != nil) != c.fail {
+			t.Errorf("%s: err = %v", c.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if _, err = ipdisp.Query("1.2.3.4", "t.com", "/"); err != nil {
+			t.Errorf("%s: query: %v", c.name, err)
+		}
+		if w := ipdisp.vhosts["t.com"].nodes[0].servers[0].weightstr; w != "30" {
+			t.Errorf("%s: weight = %s, want 30", c.name, w)
+		}
+	}
+}
+
+func TestSingleServerQPS(t *testing.T) {
+	ipdisp := newTestDisp(t, map[string]string{
+		"t.com/node.conf": "[a]\nserver=10.0.0.1 0 100 up qps=2\n",
+		"t.com/view.conf": "zone1|cp1;a\n",
+	})
+	svr := ipdisp.vhosts["t.com"].nodes[0].servers[0]
+	for i := 0; i < 3; i++ {
+		res, err := ipdisp.Query("1.2.3.4", "t.com", "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.IP != "10.0.0.1" {
+			t.Errorf("ip = %s", res.IP)
+		}
+	}
+	if n := svr.qpswin.count(time.Now()); n != 3 {
+		t.Errorf("server qps = %v, want 3", n)
+	}
+	if svr.qpsfull(time.Now()) == false {
+		t.Errorf("server qps not full")
+	}
+}
+
+func TestCarry(t *testing.T) {
+	//服务器ID不是从0开始的连续数字
+	files := map[string]string{
+		"t.com/node.conf": "[a]\nbalance=A\nserver=10.0.0.1 7 60\nserver=10.0.0.2 3 40\n[b]\nserver=10.0.0.3 5 100\n",
+		"t.com/view.conf": "zone1|cp1;a\n",
+	}
+	old := newTestDisp(t, files)
+	sets := []struct {
+		object string
+		values []string
+	}{
+		{"node", []string{"a:status:down"}},
+		{"server", []string{"a:10.0.0.1:weight:30", "a:10.0.0.2:weight:70"}},
+		{"zone", []string{"zone2|cp2:b:100"}},
+		{"node", []string{"a:status:up"}},
+		{"node", []string{"a:status:down"}},
+	}
+	for _, s := range sets {
+		if err := old.Set("t.com", s.object, s.values); err != nil {
+			t.Fatalf("Set %v: %v", s.values, err)
+		}
+	}
+	//定时推送的带宽只保留最后一次
+	for bw := 1; bw <= 100; bw++ {
+		if err := old.Set("t.com", "node", []string{"b:bw:" + strconv.Itoa(bw)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(old.overrides) != 5 {
+		t.Errorf("overrides = %d, want 5: %v", len(old.overrides), old.overrides)
+	}
+	old.Query("1.2.3.4", "t.com", "/")
+	ins := newTestDisp(t, files)
+	ins.Carry(old)
+	vhost := ins.vhosts["t.com"]
+	if vhost.nodes[0].status == 0 {
+		t.Errorf("node status not carried")
+	}
+	if bw := vhost.nodes[1].bw; bw != 100 {
+		t.Errorf("node bw = %d, want 100", bw)
+	}
+	if w := vhost.nodes[0].servers[0].weightstr; w != "30" {
+		t.Errorf("server weight = %s, want 30", w)
+	}
+	if w := vhost.baseview.zoneweight[ins.zoneID["zone2|cp2"]]; len(w) == 0 {
+		t.Errorf("zone weight not carried")
+	}
+	if ins.reqcount != old.reqcount || vhost.reqcount != 1 {
+		t.Errorf("reqcount = %d/%d, want %d/1", ins.reqcount, vhost.reqcount, old.reqcount)
+	}
+	if vhost.nodes[0].servers[0].qpswin != old.vhosts["t.com"].nodes[0].servers[0].qpswin {
+		t.Errorf("server qps window not carried")
+	}
+	if len(ins.overrides) != len(old.overrides) {
+		t.Errorf("overrides after carry = %d, want %d", len(ins.overrides), len(old.overrides))
+	}
+}
+
+func TestLocationToken(t *testing.T) {
+	ipdisp := newTestDisp(t, map[string]string{
+		"t.com/node.conf": "[conf]\ntokenkey=k1:secret\n[a]\nserver=10.0.0.1 0 100\n",
+		"t.com/view.conf": "zone1|cp1;a\n",
+	})
+	res, err := ipdisp.Query("1.2.3.4", "t.com", "/a.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := urlsign.Keys{}
+	ks.Add(urlsign.Key{ID: "k1", Secret: []byte("secret")})
+	//缓存的调度结果用于其他客户端时，鉴权串绑定访问的客户端
+	for _, clip := range []string{"1.2.3.4", "1.2.3.5", ""} {
+		u, err := url.Parse(res.Location("http", "/a.mp4", "", clip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ks.VerifyURL(u, "", clip, time.Now()); err != nil {
+			t.Errorf("%q: %v", clip, err)
+		}
+	}
+}
+
+func TestLookupWildcard(t *testing.T) {
+	ipdisp := newTestDisp(t, map[string]string{
+		"t.com/node.conf":   "[conf]\nalias=*.t.net,*.b.t.net\ncatchall=yes\n[a]\nserver=10.0.0.1 0 100\n",
+		"t.com/view.conf":   "zone1|cp1;a\n",
+		"*.t.org/node.conf": "[a]\nserver=10.0.0.2 0 100\n",
+		"*.t.org/view.conf": "zone1|cp1;a\n",
+	})
+	cases := []struct {
+		host  string
+		vhost string
+	}{
+		{"t.com", "t.com"},
+		{"T.COM.:80", "t.com"},
+		{"a.t.net", "t.com"},
+		{"a.b.t.net", "t.com"},
+		{"x.a.t.net", ""},
+		{"t.net", ""},
+		{"a.t.org", "*.t.org"},
+		{"a.b.t.org", ""},
+		{"t.org", ""},
+	}
+	for _, c := range cases {
+		vhost, ok := ipdisp.lookup(c.host)
+		name := ""
+		if ok {
+			name = vhost.name
+		}
+		if name != c.vhost {
+			t.Errorf("lookup(%s) = %q, want %q", c.host, name, c.vhost)
+		}
+		if vhost, ok = ipdisp.match(c.host); ok == false || (c.vhost == "" && vhost.name != "t.com") {
+			t.Errorf("match(%s) did not fall back to catchall", c.host)
+		}
+		if _, err := ipdisp.QueryHost("1.2.3.4", c.host, "/"); (err == nil) != (c.vhost != "") {
+			t.Errorf("QueryHost(%s): err = %v", c.host, err)
+		}
+	}
+}
+
+func TestExplainReadOnly(t *testing.T) {
+	ipdisp := newTestDisp(t, map[string]string{
+		"t.com/node.conf": "[a]\nserver=10.0.0.1 0 100\nmaxbw=100\nbw=200\noverflow2node=b\n[b]\nserver=10.0.0.2 0 100\nmaxbw=100\nbw=200\n",
+		"t.com/view.conf": "zone1|cp1;a\n",
+	})
+	clk := newFakeClock()
+	vhost := ipdisp.vhosts["t.com"]
+	for _, node := range vhost.nodes {
+		node.ovl.now = clk.now
+		node.ovl.last = clk.now()
+	}
+	clk.advance(2 * ovlInterval)
+	tr := ipdisp.Explain("1.2.3.4", "t.com", "/")
+	if tr.Error != "" {
+		t.Fatal(tr.Error)
+	}
+	for _, node := range vhost.nodes {
+		if node.ovl.last.Equal(clk.now()) || node.ovl.sampled || node.shedratio != 0 {
+			t.Errorf("explain updated overload controller of node %s", node.name)
+		}
+	}
+	if _, err := ipdisp.Query("1.2.3.4", "t.com", "/"); err != nil {
+		t.Fatal(err)
+	}
+	if vhost.nodes[0].ovl.sampled == false {
+		t.Errorf("query did not update overload controller")
+	}
+}
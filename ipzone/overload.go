@@ -0,0 +1,112 @@
+package ipzone
+
+import (
+	"time"
+)
+
+const (
+	//ovlInterval 过载控制器的采样周期
+	ovlInterval = time.Second
+	//ovlAlpha 指数平滑系数，越大越灵敏
+	ovlAlpha = 0.3
+)
+
+//overload 节点过载控制器。
+//用平滑后的带宽和请求速率估算节点承担全部请求时的带宽，与目标利用率比较，得出需要切走的流量比例。
+//进入与退出切流量状态之间留有回差，避免在阈值附近反复切换。
+type overload struct {
+	target   float64 //目标利用率（0-1），为0时按(maxbw-freebw)/maxbw计算
+	hyst     float64 //回差（0-1）
+	now      func() time.Time
+	last     time.Time
+	admitted uint64  //本周期内由节点承担的请求数
+	shed     uint64  //本周期内被切走的请求数
+	rate     float64 //平滑后分配到节点的请求速率（含被切走的）
+	arate    float64 //平滑后节点实际承担的请求速率
+	bw       float64 //平滑后的带宽
+	sampled  bool
+	active   bool
+	ratio    float64
+}
+
+//newOverload 初始化过载控制器，now为时钟，便于测试时替换
+func newOverload(now func() time.Time) *overload {
+	ovl := &overload{}
+	ovl.hyst = 0.05
+	ovl.now = now
+	ovl.last = now()
+	return ovl
+}
+
+//admit 记录一个由节点承担的请求
+func (ovl *overload) admit() {
+	ovl.admitted++
+}
+
+//drop 记录一个被切走的请求
+func (ovl *overload) drop() {
+	ovl.shed++
+}
+
+//update 根据当前带宽更新控制器，返回需要切走的流量比例（0-swMAX）
+func (ovl *overload) update(bw int, maxbw int, freebw int) int {
+	now := ovl.now()
+	elapsed := now.Sub(ovl.last)
+	if elapsed < ovlInterval {
+		return ovl.level()
+	}
+	secs := elapsed.Seconds()
+	offered := float64(ovl.admitted+ovl.shed) / secs
+	admitted := float64(ovl.admitted) / secs
+	if ovl.sampled {
+		ovl.rate = ovlAlpha*offered + (1-ovlAlpha)*ovl.rate
+		ovl.arate = ovlAlpha*admitted + (1-ovlAlpha)*ovl.arate
+		ovl.bw = ovlAlpha*float64(bw) + (1-ovlAlpha)*ovl.bw
+	} else {
+		ovl.rate = offered
+		ovl.arate = admitted
+		ovl.bw = float64(bw)
+		ovl.sampled = true
+	}
+	ovl.last = now
+	ovl.admitted = 0
+	ovl.shed = 0
+
+	if maxbw <= 0 {
+		ovl.active = false
+		ovl.ratio = 0
+		return 0
+	}
+	target := ovl.target
+	if target <= 0 {
+		target = float64(maxbw-freebw) / float64(maxbw)
+	}
+	//带宽只反映节点承担的请求，按请求速率折算出不切流量时的带宽
+	load := ovl.bw
+	if ovl.arate > 0 {
+		load = ovl.bw * ovl.rate / ovl.arate
+	}
+	util := load / float64(maxbw)
+	switch {
+	case !ovl.active && util > target+ovl.hyst:
+		ovl.active = true
+	case ovl.active && util < target-ovl.hyst:
+		ovl.active = false
+	}
+	ovl.ratio = 0
+	if ovl.active && load > 0 {
+		ovl.ratio = 1 - target*float64(maxbw)/load
+		switch {
+		case ovl.ratio < 0:
+			ovl.ratio = 0
+		case ovl.ratio > 1:
+			ovl.ratio = 1
+		}
+	}
+	return ovl.level()
+}
+
+//level 以0-swMAX表示的切流量比例
+func (ovl *overload) level() int {
+	return int(ovl.ratio * swMAX)
+}
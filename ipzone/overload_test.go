@@ -0,0 +1,134 @@
+package ipzone
+
+import (
+	"testing"
+	"time"
+)
+
+//fakeClock 测试用的时钟
+type fakeClock struct {
+	t time.Time
+}
+
+func (clk *fakeClock) now() time.Time {
+	return clk.t
+}
+
+func (clk *fakeClock) advance(d time.Duration) {
+	clk.t = clk.t.Add(d)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+//ovlInput 一个采样周期内的输入
+type ovlInput struct {
+	admitted int
+	shed     int
+	bw       int
+}
+
+//drive 以相同的输入驱动控制器steps个周期，平滑后的值收敛到输入，返回最后的切流量比例
+func drive(ovl *overload, clk *fakeClock, in ovlInput, maxbw int, freebw int, steps int) (level int) {
+	for i := 0; i < steps; i++ {
+		for j := 0; j < in.admitted; j++ {
+			ovl.admit()
+		}
+		for j := 0; j < in.shed; j++ {
+			ovl.drop()
+		}
+		clk.advance(ovlInterval)
+		level = ovl.update(in.bw, maxbw, freebw)
+	}
+	return
+}
+
+func TestOverloadLevel(t *testing.T) {
+	cases := []struct {
+		name   string
+		target float64
+		in     ovlInput
+		maxbw  int
+		freebw int
+		want   int
+	}{
+		{"under target", 0.8, ovlInput{admitted: 100, bw: 70}, 100, 0, 0},
+		{"inside band", 0.8, ovlInput{admitted: 100, bw: 84}, 100, 0, 0},
+		{"over band", 0.8, ovlInput{admitted: 100, bw: 90}, 100, 0, 1111},
+		{"shed traffic counted as load", 0.8, ovlInput{admitted: 50, shed: 50, bw: 50}, 100, 0, 2000},
+		{"default target from freebw", 0, ovlInput{admitted: 100, bw: 90}, 100, 20, 1111},
+		{"default target below band", 0, ovlInput{admitted: 100, bw: 80}, 100, 10, 0},
+		{"clamped to swMAX", 0, ovlInput{admitted: 100, bw: 50}, 100, 150, swMAX},
+		{"no maxbw", 0.8, ovlInput{admitted: 100, bw: 1000}, 0, 0, 0},
+	}
+	for _, c := range cases {
+		clk := newFakeClock()
+		ovl := newOverload(clk.now)
+		ovl.target = c.target
+		got := drive(ovl, clk, c.in, c.maxbw, c.freebw, 60)
+		if diff := got - c.want; diff < -1 || diff > 1 {
+			t.Errorf("%s: level = %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestOverloadHysteresis(t *testing.T) {
+	clk := newFakeClock()
+	ovl := newOverload(clk.now)
+	ovl.target = 0.8
+	steps := []struct {
+		bw     int
+		active bool
+		level  int
+	}{
+		{84, false, 0},   //低于target+hyst，不进入
+		{90, true, 1111}, //超过target+hyst，进入
+		{78, true, 0},    //回差内保持切流量状态，比例限制为0
+		{70, false, 0},   //低于target-hyst，退出
+		{84, false, 0},   //回差内保持未切流量状态
+	}
+	for i, s := range steps {
+		level := drive(ovl, clk, ovlInput{admitted: 100, bw: s.bw}, 100, 0, 60)
+		if ovl.active != s.active {
+			t.Errorf("step %d bw %d: active = %v, want %v", i, s.bw, ovl.active, s.active)
+		}
+		if diff := level - s.level; diff < -1 || diff > 1 {
+			t.Errorf("step %d bw %d: level = %d, want %d", i, s.bw, level, s.level)
+		}
+	}
+}
+
+func TestOverloadWindow(t *testing.T) {
+	clk := newFakeClock()
+	ovl := newOverload(clk.now)
+	ovl.target = 0.5
+	for i := 0; i < 100; i++ {
+		ovl.admit()
+	}
+	//采样周期内不更新，保留计数和原来的比例
+	clk.advance(ovlInterval / 2)
+	if level := ovl.update(100, 100, 0); level != 0 || ovl.sampled || ovl.admitted != 100 {
+		t.Fatalf("update inside interval: level %d, sampled %v, admitted %d", level, ovl.sampled, ovl.admitted)
+	}
+	//周期结束时按经过的时间计算速率，并清零计数
+	clk.advance(ovlInterval / 2)
+	if level := ovl.update(100, 100, 0); level != 5000 {
+		t.Errorf("level = %d, want 5000", level)
+	}
+	if ovl.admitted != 0 || ovl.shed != 0 {
+		t.Errorf("counters not reset: admitted %d, shed %d", ovl.admitted, ovl.shed)
+	}
+	if ovl.rate != 100 || ovl.arate != 100 {
+		t.Errorf("rate = %v, arate = %v, want 100", ovl.rate, ovl.arate)
+	}
+	//下一个周期的请求速率只包含新的计数，按平滑系数更新
+	for i := 0; i < 200; i++ {
+		ovl.admit()
+	}
+	clk.advance(2 * ovlInterval)
+	ovl.update(100, 100, 0)
+	if want := ovlAlpha*100 + (1-ovlAlpha)*100; ovl.rate != want {
+		t.Errorf("rate = %v, want %v", ovl.rate, want)
+	}
+}
@@ -0,0 +1,330 @@
+package ipzone
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dale-di/ipdispatch/urlsign"
+)
+
+const (
+	//defaultTTL 调度结果默认的有效期（秒）
+	defaultTTL = 60
+	//defaultTokenTTL 鉴权串默认的有效期
+	defaultTokenTTL = 5 * time.Minute
+)
+
+//redirect 跳转的配置，在node.conf的[conf]段中设置
+type redirect struct {
+	scheme string //keep：与客户端请求的协议相同；http或https：固定使用此协议
+	query  bool   //是否保留查询字符串
+	status int    //跳转的状态码
+	url    string //跳转地址模板
+	ttl    int    //调度结果的有效期（秒）
+	dnsnum int    //DNS应答中的最大地址数
+	mode   string //调度方式：redirect：跳转；manifest：改写HLS/DASH播放列表；proxy：代理
+	origin string //manifest方式下播放列表的源站地址
+	token  *token //跳转地址的鉴权串，为nil时不加鉴权串
+}
+
+//token 跳转地址鉴权串的配置，边缘服务器以urlsign包校验
+type token struct {
+	key   urlsign.Key
+	ttl   time.Duration
+	param string
+	bind  bool //是否绑定客户端IP
+	proxy bool //mode=proxy时是否绑定客户端IP
+}
+
+//newRedirect 初始化跳转配置
+func newRedirect() *redirect {
+	rd := &redirect{}
+	rd.scheme = "keep"
+	rd.query = true
+	rd.status = http.StatusFound
+	rd.ttl = defaultTTL
+	rd.dnsnum = 1
+	rd.mode = "redirect"
+	return rd
+}
+
+//set 设置[conf]段的配置项
+func (vhost *Vhost) set(key string, value string) (err error) {
+	switch key {
+	case "scheme":
+		switch value {
+		case "keep", "http", "https":
+			vhost.redirect.scheme = value
+		default:
+			err = errors.New("not valid scheme: " + value)
+		}
+	case "query":
+		switch value {
+		case "keep":
+			vhost.redirect.query = true
+		case "drop":
+			vhost.redirect.query = false
+		default:
+			err = errors.New("not valid query: " + value)
+		}
+	case "url":
+		vhost.redirect.url = value
+	case "ttl":
+		var ttl int
+		if ttl, err = strconv.Atoi(value); err != nil || ttl < 0 {
+			err = errors.New("not valid ttl: " + value)
+			break
+		}
+		vhost.redirect.ttl = ttl
+	case "dnsnum":
+		var num int
+		if num, err = strconv.Atoi(value); err != nil || num <= 0 {
+			err = errors.New("not valid dnsnum: " + value)
+			break
+		}
+		vhost.redirect.dnsnum = num
+	case "mode":
+		switch value {
+		case "redirect", "manifest", "proxy":
+			vhost.redirect.mode = value
+		default:
+			err = errors.New("not valid mode: " + value)
+		}
+	case "origin":
+		if strings.HasPrefix(value, "http://") == false && strings.HasPrefix(value, "https://") == false {
+			err = errors.New("not valid origin: " + value)
+			break
+		}
+		vhost.redirect.origin = strings.TrimSuffix(value, "/")
+	case "fail", "failurl", "failbody", "failretry":
+		if vhost.failure == nil {
+			vhost.failure = &Failure{}
+		}
+		err = vhost.failure.Set(key, value)
+	case "alias", "catchall":
+		err = vhost.sethost(key, value)
+	case "tokenkey", "tokenttl", "tokenparam", "tokenip", "tokenproxyip":
+		err = vhost.settoken(key, value)
+	case "status":
+		var status int
+		status, err = strconv.Atoi(value)
+		switch status {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+			http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			vhost.redirect.status = status
+		default:
+			err = errors.New("not valid status: " + value)
+		}
+	default:
+		err = errors.New("not valid conf config: " + key)
+	}
+	return
+}
+
+//Location 生成跳转地址。scheme为客户端请求的协议，path为转义后的请求路径，query为请求的查询字符串（不含?），
+//clip为访问跳转地址的客户端IP，鉴权串绑定此IP，为空时不绑定。
+//依次使用server、节点、[conf]段中设置的跳转地址模板，都没有设置时跳转到服务器地址
+func (res *Result) Location(scheme string, path string, query string, clip string) string {
+	rd := res.vhost.redirect
+	if rd.query == false {
+		query = ""
+	}
+	if rd.scheme != "keep" {
+		scheme = rd.scheme
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	var loc string
+	if tmpl := res.template(); tmpl != "" {
+		loc = res.expand(tmpl, scheme, path, query)
+	} else {
+		loc = addquery(scheme+"://"+res.server.hostport(res.IP)+path, query)
+	}
+	if res.node.cdn != nil {
+		loc = res.node.cdn.signurl(loc, path, time.Now())
+	} else if rd.token != nil {
+		loc = rd.token.sign(loc, clip, time.Now())
+	}
+	return loc
+}
+
+//settoken 设置跳转地址鉴权串的配置项
+func (vhost *Vhost) settoken(key string, value string) (err error) {
+	tk := vhost.redirect.token
+	if tk == nil {
+		tk = &token{ttl: defaultTokenTTL, param: urlsign.DefaultParam, bind: true}
+	}
+	switch key {
+	case "tokenkey":
+		tk.key, err = urlsign.ParseKey(value)
+	case "tokenttl":
+		var ttl int
+		if ttl, err = strconv.Atoi(value); err != nil || ttl <= 0 {
+			return errors.New("not valid tokenttl: " + value)
+		}
+		tk.ttl = time.Duration(ttl) * time.Second
+	case "tokenparam":
+		tk.param = value
+	case "tokenip":
+		switch value {
+		case "yes":
+			tk.bind = true
+		case "no":
+			tk.bind = false
+		default:
+			err = errors.New("not valid tokenip: " + value)
+		}
+	case "tokenproxyip":
+		switch value {
+		case "yes":
+			tk.proxy = true
+		case "no":
+			tk.proxy = false
+		default:
+			err = errors.New("not valid tokenproxyip: " + value)
+		}
+	}
+	vhost.redirect.token = tk
+	return
+}
+
+//ProxyClip 返回代理方式下鉴权串绑定的客户端IP。
+//代理的请求由调度服务发出，只有设置了tokenproxyip=yes时才绑定客户端IP，边缘服务器需以X-Real-IP头中的地址校验
+func (res *Result) ProxyClip(clip string) string {
+	if tk := res.vhost.redirect.token; tk != nil && tk.proxy {
+		return clip
+	}
+	return ""
+}
+
+//sign 在跳转地址后加上鉴权串，签名使用跳转地址中的路径
+func (tk *token) sign(loc string, clip string, now time.Time) string {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return loc
+	}
+	if tk.bind == false {
+		clip = ""
+	}
+	return addquery(loc, tk.param+"="+urlsign.Sign(tk.key, u.Path, clip, now.Add(tk.ttl)))
+}
+
+//template 返回跳转地址模板
+func (res *Result) template() string {
+	switch {
+	case res.node.cdn != nil:
+		return res.node.cdn.url
+	case res.server != nil && res.server.url != "":
+		return res.server.url
+	case res.node.url != "":
+		return res.node.url
+	}
+	return res.vhost.redirect.url
+}
+
+//expand 展开跳转地址模板。可用变量：
+//{scheme}：协议；{host}：请求的域名；{path}：请求路径；{query}：查询字符串；{zone}：区域；{node}：节点；
+//{server_ip}：服务器地址；{server_id}：服务器ID；{port}：服务器端口；{server}：服务器地址和端口；{cdn_host}：CDN域名。
+//模板中没有{query}时，查询字符串加在地址末尾
+func (res *Result) expand(tmpl string, scheme string, path string, query string) string {
+	if query == "" {
+		tmpl = strings.NewReplacer("?{query}", "", "&{query}", "").Replace(tmpl)
+	}
+	vars := []string{
+		"{scheme}", scheme,
+		"{host}", res.host,
+		"{path}", path,
+		"{query}", query,
+		"{zone}", res.Zone,
+		"{node}", res.Node,
+	}
+	if res.node.cdn != nil {
+		vars = append(vars, "{cdn_host}", res.node.cdn.host)
+	}
+	if res.server != nil {
+		port := ""
+		if res.server.port > 0 {
+			port = strconv.Itoa(res.server.port)
+		}
+		vars = append(vars,
+			"{server_ip}", res.IP,
+			"{server_id}", strconv.Itoa(res.server.id),
+			"{port}", port,
+			"{server}", res.server.hostport(res.IP),
+		)
+	}
+	loc := strings.NewReplacer(vars...).Replace(tmpl)
+	if strings.Contains(tmpl, "{query}") == false {
+		loc = addquery(loc, query)
+	}
+	return loc
+}
+
+//addquery 在地址末尾加上查询参数
+func addquery(loc string, query string) string {
+	switch {
+	case query == "":
+		return loc
+	case strings.Contains(loc, "?"):
+		return loc + "&" + query
+	}
+	return loc + "?" + query
+}
+
+//Status 返回跳转的状态码
+func (res *Result) Status() int {
+	return res.vhost.redirect.status
+}
+
+//TTL 返回调度结果的有效期（秒）
+func (res *Result) TTL() int {
+	return res.vhost.redirect.ttl
+}
+
+//Mode 返回域名的调度方式
+func (res *Result) Mode() string {
+	return res.vhost.redirect.mode
+}
+
+//Origin 返回manifest方式下播放列表的源站地址
+func (res *Result) Origin() string {
+	return res.vhost.redirect.origin
+}
+
+//DNSNum 返回DNS应答中的最大地址数
+func (res *Result) DNSNum() int {
+	return res.vhost.redirect.dnsnum
+}
+
+//CDNHost 调度到第三方CDN时返回CDN的域名，否则返回空
+func (res *Result) CDNHost() string {
+	if res.node.cdn == nil {
+		return ""
+	}
+	return res.node.cdn.host
+}
+
+//ServerID 返回调度到的服务器ID，调度到第三方CDN时返回-1
+func (res *Result) ServerID() int {
+	if res.server == nil {
+		return -1
+	}
+	return res.server.id
+}
+
+//hostport 返回跳转地址中的主机部分，设置了端口时加上端口
+func (svr *Server) hostport(ip string) string {
+	if svr.port > 0 {
+		return net.JoinHostPort(ip, strconv.Itoa(svr.port))
+	}
+	if addr := net.ParseIP(ip); addr != nil && addr.To4() == nil {
+		return "[" + ip + "]"
+	}
+	return ip
+}
@@ -0,0 +1,112 @@
+package ipzone
+
+import "testing"
+
+func TestLocation(t *testing.T) {
+	cases := []struct {
+		name   string
+		conf   string
+		node   string
+		scheme string
+		query  string
+		want   string
+	}{
+		{
+			name:  "server address",
+			node:  "server=10.0.0.1 3 100",
+			query: "a=1",
+			want:  "http://10.0.0.1/v/a%20b.mp4?a=1",
+		},
+		{
+			name: "server port and ipv6",
+			node: "server=2001:db8::1 3 100 up port=8080",
+			want: "http://[2001:db8::1]:8080/v/a%20b.mp4",
+		},
+		{
+			name:   "conf template",
+			conf:   "url={scheme}://{node}-{server_id}.{host}{path}?zone={zone}",
+			node:   "server=10.0.0.1 3 100",
+			scheme: "https",
+			query:  "a=1",
+			want:   "https://a-3.t.com/v/a%20b.mp4?zone=zone1|cp1&a=1",
+		},
+		{
+			name:  "template with query",
+			conf:  "url=http://{server}/x{path}?{query}",
+			node:  "server=10.0.0.1 3 100 up port=81",
+			query: "a=1",
+			want:  "http://10.0.0.1:81/x/v/a%20b.mp4?a=1",
+		},
+		{
+			name: "template with empty query",
+			conf: "url=http://{server_ip}:{port}{path}?t=1&{query}",
+			node: "server=10.0.0.1 3 100 up port=81",
+			want: "http://10.0.0.1:81/v/a%20b.mp4?t=1",
+		},
+		{
+			name: "node template over conf",
+			conf: "url=http://conf{path}",
+			node: "url=http://node.{host}{path}\nserver=10.0.0.1 3 100",
+			want: "http://node.t.com/v/a%20b.mp4",
+		},
+		{
+			name: "server template over node",
+			node: "url=http://node{path}\nserver=10.0.0.1 3 100 up url=http://svr{path}",
+			want: "http://svr/v/a%20b.mp4",
+		},
+		{
+			name:  "drop query and force scheme",
+			conf:  "query=drop\nscheme=https",
+			node:  "server=10.0.0.1 3 100",
+			query: "a=1",
+			want:  "https://10.0.0.1/v/a%20b.mp4",
+		},
+	}
+	for _, c := range cases {
+		ipdisp := newTestDisp(t, map[string]string{
+			"t.com/node.conf": "[conf]\n" + c.conf + "\n[a]\n" + c.node + "\n",
+			"t.com/view.conf": "zone1|cp1;a\n",
+		})
+		res, err := ipdisp.Query("1.2.3.4", "t.com", "/v/a b.mp4")
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if c.scheme == "" {
+			c.scheme = "http"
+		}
+		if got := res.Location(c.scheme, "/v/a%20b.mp4", c.query, "1.2.3.4"); got != c.want {
+			t.Errorf("%s: location = %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestVhostSet(t *testing.T) {
+	cases := []struct {
+		key   string
+		value string
+		ok    bool
+	}{
+		{key: "scheme", value: "https", ok: true},
+		{key: "scheme", value: "ftp"},
+		{key: "status", value: "307", ok: true},
+		{key: "status", value: "200"},
+		{key: "failurl", value: "http://b.t.com/", ok: true},
+		{key: "tokenproxyip", value: "yes", ok: true},
+		{key: "dnsnun", value: "2"},
+		{key: "Mode", value: "proxy"},
+	}
+	for _, c := range cases {
+		vhost := &Vhost{redirect: newRedirect()}
+		if err := vhost.set(c.key, c.value); (err == nil) != c.ok {
+			t.Errorf("%s=%s: err = %v, want ok %v", c.key, c.value, err, c.ok)
+		}
+	}
+	//[conf]段的拼写错误在加载时报错
+	if _, err := loadTestDisp(t, map[string]string{
+		"t.com/node.conf": "[conf]\nsheme=https\n[a]\nserver=10.0.0.1 0 100\n",
+		"t.com/view.conf": "zone1|cp1;a\n",
+	}); err == nil {
+		t.Error("unknown conf key loaded")
+	}
+}
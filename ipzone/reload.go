@@ -0,0 +1,90 @@
+package ipzone
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+//override 通过Set修改的一项设置
+type override struct {
+	host   string //虚拟主机的配置目录名
+	object string
+	target string //设置的对象，即value去掉最后一项的值，如node:bw、node:ip:weight、zone:node
+	value  string
+}
+
+//record 记录Set修改的设置。同一对象只保留最后一次的值，定时推送的带宽等设置不会使记录增长
+func (ipdisp *IPDisp) record(host string, object string, values []string) {
+	for _, v := range values {
+		o := override{host: host, object: object, value: v}
+		if i := strings.LastIndex(v, ":"); i >= 0 {
+			o.target = v[:i]
+		}
+		kept := ipdisp.overrides[:0]
+		for _, old := range ipdisp.overrides {
+			if old.host != o.host || old.object != o.object || old.target != o.target {
+				kept = append(kept, old)
+			}
+		}
+		ipdisp.overrides = append(kept, o)
+	}
+}
+
+//Carry 重新加载配置后，从原来的IPDisp继承通过Set修改的设置、请求计数和请求速率窗口。
+//同一虚拟主机、同一类对象的设置一起生效（服务器的权重需要一起检查）；一起设置失败时逐项设置，
+//在新配置中已无效的设置（如节点或服务器已删除）不再保留
+func (ipdisp *IPDisp) Carry(old *IPDisp) {
+	var groups [][2]string
+	values := make(map[[2]string][]string)
+	for _, o := range old.overrides {
+		key := [2]string{o.host, o.object}
+		if _, ok := values[key]; ok == false {
+			groups = append(groups, key)
+		}
+		values[key] = append(values[key], o.value)
+	}
+	for _, key := range groups {
+		if ipdisp.Set(key[0], key[1], values[key]) == nil {
+			continue
+		}
+		for _, v := range values[key] {
+			if err := ipdisp.Set(key[0], key[1], []string{v}); err != nil {
+				fmt.Fprintf(os.Stderr, "reload: drop %s %s %s: %v\n", key[0], key[1], v, err)
+			}
+		}
+	}
+	ipdisp.reqcount = old.reqcount
+	ipdisp.othercount = old.othercount
+	for reason, n := range old.failcount {
+		ipdisp.failcount[reason] = n
+	}
+	for name, vhost := range ipdisp.vhosts {
+		ov, ok := old.vhosts[name]
+		if ok == false {
+			continue
+		}
+		vhost.reqcount = ov.reqcount
+		vhost.reqwin = ov.reqwin
+		for _, node := range vhost.nodes {
+			nid, ok := ov.nodeID[node.name]
+			if ok == false {
+				continue
+			}
+			on := ov.nodes[nid]
+			node.reqcount = on.reqcount
+			node.reqmin = on.reqmin
+			node.reqlastmin = on.reqlastmin
+			node.shedcount = on.shedcount
+			node.qpswin = on.qpswin
+			if node.cdn != nil && on.cdn != nil {
+				node.cdn.reqwin = on.cdn.reqwin
+			}
+			for _, svr := range node.servers {
+				if sid, ok := on.serverID[svr.ip]; ok {
+					svr.qpswin = on.servers[sid].qpswin
+				}
+			}
+		}
+	}
+}
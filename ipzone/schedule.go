@@ -0,0 +1,224 @@
+package ipzone
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//schedule 定时生效的配置，在node.conf中以[schedule:name]段定义。
+//在time指定的时间段内，替换区域与节点的对应关系、服务器权重和节点的目标利用率
+type schedule struct {
+	name     string
+	loc      *time.Location
+	ranges   [][2]int //生效的时间段，以当天的分钟数表示，结束时间小于开始时间时跨越零点
+	viewfile string
+	view     *view
+	weights  []string //node:server-ip:weight
+	targets  []string //node:target
+}
+
+//newSchedule 初始化定时配置
+func newSchedule(name string) *schedule {
+	sch := &schedule{}
+	sch.name = name
+	sch.loc = time.Local
+	return sch
+}
+
+//set 设置定时配置的配置项
+func (sch *schedule) set(key string, value string) (err error) {
+	switch key {
+	case "time":
+		//time=19:00-23:00
+		se := strings.Split(value, "-")
+		if len(se) != 2 {
+			return errors.New("not valid time: " + value)
+		}
+		var r [2]int
+		for i, hm := range se {
+			var t time.Time
+			if t, err = time.Parse("15:04", strings.TrimSpace(hm)); err != nil {
+				return errors.New("not valid time: " + value)
+			}
+			r[i] = t.Hour()*60 + t.Minute()
+		}
+		sch.ranges = append(sch.ranges, r)
+	case "tz":
+		sch.loc, err = time.LoadLocation(value)
+	case "view":
+		sch.viewfile = value
+	case "weight":
+		if len(strings.Split(value, ":")) != 3 {
+			return errors.New("not valid weight: " + value)
+		}
+		sch.weights = append(sch.weights, value)
+	case "target":
+		if len(strings.Split(value, ":")) != 2 {
+			return errors.New("not valid target: " + value)
+		}
+		sch.targets = append(sch.targets, value)
+	default:
+		err = errors.New("not valid schedule config: " + key)
+	}
+	return
+}
+
+//match 判断定时配置在t时刻是否生效
+func (sch *schedule) match(t time.Time) bool {
+	t = t.In(sch.loc)
+	m := t.Hour()*60 + t.Minute()
+	for _, r := range sch.ranges {
+		if r[0] <= r[1] {
+			if m >= r[0] && m < r[1] {
+				return true
+			}
+		} else if m >= r[0] || m < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+//initschedule 检查定时配置引用的节点、服务器和权重，并加载定时配置的view文件
+func (ipdisp *IPDisp) initschedule(vhost *Vhost, dir string) (err error) {
+	for _, sch := range vhost.schedules {
+		for _, w := range sch.weights {
+			items := strings.Split(w, ":")
+			if _, _, err = vhost.server(items[0], items[1]); err != nil {
+				return errors.New(sch.name + ": " + err.Error())
+			}
+		}
+		for node, weights := range sch.nodeweights(vhost) {
+			strs := make([]string, len(node.servers))
+			for i, svr := range node.servers {
+				if w, ok := weights[svr]; ok {
+					strs[i] = w
+				} else {
+					strs[i] = svr.baseweight
+				}
+			}
+			if err = node.checkweights(strs); err != nil {
+				return errors.New(sch.name + ": " + node.name + ": " + err.Error())
+			}
+		}
+		for _, t := range sch.targets {
+			items := strings.Split(t, ":")
+			if _, ok := vhost.nodeID[items[0]]; ok == false {
+				return errors.New(sch.name + ": not valid node: " + items[0])
+			}
+			if _, err = strconv.Atoi(items[1]); err != nil {
+				return errors.New(sch.name + ": not valid target: " + t)
+			}
+		}
+		if sch.viewfile == "" {
+			continue
+		}
+		if sch.view, err = ipdisp.parseview(filepath.Join(dir, sch.viewfile), vhost); err != nil {
+			return
+		}
+		ipdisp.initfallback(vhost, sch.view)
+	}
+	return
+}
+
+//findschedule 返回t时刻生效的定时配置，有多个时使用配置文件中的第一个，没有时返回nil
+func (vhost *Vhost) findschedule(t time.Time) *schedule {
+	for _, sch := range vhost.schedules {
+		if sch.match(t) {
+			return sch
+		}
+	}
+	return nil
+}
+
+//checkschedule 每分钟检查一次生效的定时配置，发生变化时切换配置
+func (vhost *Vhost) checkschedule(now time.Time) {
+	if len(vhost.schedules) == 0 || now.Unix()/60 == vhost.schedmin {
+		return
+	}
+	vhost.schedmin = now.Unix() / 60
+	sch := vhost.findschedule(now)
+	if sch == vhost.schedule {
+		return
+	}
+	vhost.applyschedule(sch)
+}
+
+//nodeweights 返回定时配置中各节点服务器的权重
+func (sch *schedule) nodeweights(vhost *Vhost) map[*Node]map[*Server]string {
+	weights := make(map[*Node]map[*Server]string)
+	for _, w := range sch.weights {
+		items := strings.Split(w, ":")
+		//initschedule中已检查节点和服务器
+		node, svr, _ := vhost.server(items[0], items[1])
+		if weights[node] == nil {
+			weights[node] = make(map[*Server]string)
+		}
+		weights[node][svr] = items[2]
+	}
+	return weights
+}
+
+//applyschedule 切换到定时配置，sch为nil时恢复默认配置。
+//切换后服务器的权重为定时配置或node.conf中的权重，运行时通过Set修改的区域权重在每个view中都已生效
+func (vhost *Vhost) applyschedule(sch *schedule) {
+	vhost.schedule = sch
+	vhost.view = vhost.baseview
+	name := "default"
+	weights := make(map[*Node]map[*Server]string)
+	targets := make(map[*Node]float64)
+	if sch != nil {
+		name = sch.name
+		if sch.view != nil {
+			vhost.view = sch.view
+		}
+		weights = sch.nodeweights(vhost)
+		for _, t := range sch.targets {
+			items := strings.Split(t, ":")
+			target, _ := strconv.Atoi(items[1])
+			targets[vhost.nodes[vhost.nodeID[items[0]]]] = float64(target) / 100
+		}
+	}
+	for _, node := range vhost.nodes {
+		if target, ok := targets[node]; ok {
+			node.ovl.target = target
+		} else {
+			node.ovl.target = node.basetarget
+		}
+		changed := make(map[*Server]string)
+		for _, svr := range node.servers {
+			weight, ok := weights[node][svr]
+			if ok == false {
+				weight = svr.baseweight
+			}
+			if weight != svr.weightstr {
+				changed[svr] = weight
+			}
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		if err := node.resetbalance(changed); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: schedule %s: %s: %s\n", vhost.name, name, node.name, err)
+		}
+	}
+}
+
+//Schedule 返回t时刻生效的定时配置名称，没有生效的定时配置时返回default
+func (ipdisp *IPDisp) Schedule(host string, t time.Time) (name string, err error) {
+	vhost, ok := ipdisp.lookup(host)
+	if ok != true {
+		err = errors.New("Not found " + host)
+		return
+	}
+	name = "default"
+	if sch := vhost.findschedule(t); sch != nil {
+		name = sch.name
+	}
+	return
+}
@@ -0,0 +1,68 @@
+package ipzone
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleMatch(t *testing.T) {
+	shanghai := time.FixedZone("CST", 8*3600)
+	day := func(h int, m int) time.Time {
+		return time.Date(2026, 1, 1, h, m, 0, 0, shanghai)
+	}
+	cases := []struct {
+		name  string
+		sets  [][2]string
+		at    time.Time
+		match bool
+	}{
+		{name: "inside", sets: [][2]string{{"time", "19:00-23:00"}}, at: day(20, 30), match: true},
+		{name: "at start", sets: [][2]string{{"time", "19:00-23:00"}}, at: day(19, 0), match: true},
+		{name: "at end", sets: [][2]string{{"time", "19:00-23:00"}}, at: day(23, 0), match: false},
+		{name: "before", sets: [][2]string{{"time", "19:00-23:00"}}, at: day(18, 59), match: false},
+		{name: "cross midnight late", sets: [][2]string{{"time", "22:00-02:00"}}, at: day(23, 30), match: true},
+		{name: "cross midnight early", sets: [][2]string{{"time", "22:00-02:00"}}, at: day(1, 59), match: true},
+		{name: "cross midnight outside", sets: [][2]string{{"time", "22:00-02:00"}}, at: day(2, 0), match: false},
+		{name: "second range", sets: [][2]string{{"time", "08:00-09:00"}, {"time", "19:00-23:00"}}, at: day(8, 30), match: true},
+		{name: "time zone", sets: [][2]string{{"tz", "UTC"}, {"time", "11:00-13:00"}}, at: day(20, 0), match: true},
+		{name: "time zone outside", sets: [][2]string{{"tz", "UTC"}, {"time", "19:00-23:00"}}, at: day(20, 0), match: false},
+		{name: "no range", at: day(20, 0), match: false},
+	}
+	for _, c := range cases {
+		sch := newSchedule(c.name)
+		sch.loc = shanghai
+		for _, kv := range c.sets {
+			if err := sch.set(kv[0], kv[1]); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+		}
+		if got := sch.match(c.at); got != c.match {
+			t.Errorf("%s: match = %v, want %v", c.name, got, c.match)
+		}
+	}
+}
+
+func TestScheduleSet(t *testing.T) {
+	cases := []struct {
+		key   string
+		value string
+		fail  bool
+	}{
+		{"time", "19:00-23:00", false},
+		{"time", " 7:00 - 9:30 ", false},
+		{"time", "19:00", true},
+		{"time", "25:00-26:00", true},
+		{"tz", "Asia/Shanghai", false},
+		{"tz", "Nowhere/City", true},
+		{"weight", "a:10.0.0.1:50", false},
+		{"weight", "a:50", true},
+		{"target", "a:80", false},
+		{"target", "80", true},
+		{"other", "x", true},
+	}
+	for _, c := range cases {
+		if err := newSchedule("s").set(c.key, c.value); (err != nil) != c.fail {
+			t.Errorf("set(%s, %q): err = %v", c.key, c.value, err)
+		}
+	}
+}
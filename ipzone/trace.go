@@ -0,0 +1,106 @@
+package ipzone
+
+import (
+	"fmt"
+	"time"
+)
+
+//Step 调度过程中的一步
+type Step struct {
+	Stage  string `json:"stage"`
+	Detail string `json:"detail"`
+}
+
+//Trace 调度过程的记录，用于排查客户端为什么被调度到某台服务器
+type Trace struct {
+	ClientIP string `json:"client_ip"`
+	Host     string `json:"host"`
+	Vhost    string `json:"vhost,omitempty"`
+	Zone     string `json:"zone,omitempty"`
+	Carrier  string `json:"carrier,omitempty"`
+	Range    string `json:"range,omitempty"` //区域中匹配的IP段
+	Schedule string `json:"schedule,omitempty"`
+	Node     string `json:"node,omitempty"`
+	Balance  string `json:"balance,omitempty"`
+	Hash     uint32 `json:"hash"`
+	Server   string `json:"server,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Steps    []Step `json:"steps"`
+}
+
+//add 记录一步，tr为nil时不记录
+func (tr *Trace) add(stage string, format string, args ...interface{}) {
+	if tr == nil {
+		return
+	}
+	tr.Steps = append(tr.Steps, Step{Stage: stage, Detail: fmt.Sprintf(format, args...)})
+}
+
+//Explain 模拟一次调度并记录每一步：客户端IP、匹配的区域和IP段、区域对应的节点、节点状态和过载检查、
+//负载均衡方式、哈希值、选中和跳过的服务器。不计入请求统计，也不改变轮询的位置
+func (ipdisp *IPDisp) Explain(clip string, host string, hashstr string) *Trace {
+	tr := &Trace{ClientIP: clip, Host: host}
+	res, err := ipdisp.query(clip, host, hashstr, tr)
+	if err != nil {
+		tr.Error = err.Error()
+		return tr
+	}
+	tr.Zone = res.Zone
+	tr.Carrier = zoneCarrier(res.Zone)
+	tr.Node = res.Node
+	tr.IP = res.IP
+	if res.server != nil {
+		tr.Server = fmt.Sprintf("%s(id %d)", res.server.ip, res.server.id)
+	}
+	return tr
+}
+
+//Batch 批量模拟调度，每项为客户端IP、域名、调度字符串。域名为空时只查找IP所在的区域和运营商
+func (ipdisp *IPDisp) Batch(items [][3]string) []*Trace {
+	trs := make([]*Trace, 0, len(items))
+	for _, item := range items {
+		var tr *Trace
+		if item[1] == "" {
+			tr = &Trace{ClientIP: item[0]}
+			if InetNetwork(item[0]) == 0 {
+				tr.Error = "Not valid ip: " + item[0]
+			}
+		} else {
+			tr = ipdisp.Explain(item[0], item[1], item[2])
+		}
+		//调度失败时（如未配置的域名）仍返回IP所在的区域
+		if tr.Zone == "" {
+			tr.Zone = ipdisp.QueryZone(item[0])
+			tr.Carrier = zoneCarrier(tr.Zone)
+		}
+		trs = append(trs, tr)
+	}
+	return trs
+}
+
+//balanceName 负载均衡方式的名称
+func balanceName(balance byte) string {
+	switch balance {
+	case 'h':
+		return "h(consistent hash)"
+	case 'r':
+		return "r(round robin)"
+	case 'a', 'A':
+		return string(balance) + "(weighted hash)"
+	case 'o':
+		return "o(single server)"
+	}
+	return string(balance)
+}
+
+//serverState 服务器不可用的原因，可用时返回空
+func serverState(svr *Server, now time.Time) string {
+	switch {
+	case svr.status != 0:
+		return "down"
+	case svr.qpsfull(now):
+		return "qps full"
+	}
+	return ""
+}
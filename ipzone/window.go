@@ -0,0 +1,46 @@
+package ipzone
+
+import (
+	"time"
+)
+
+//window 滑动窗口计数器。用上一个窗口按剩余时间折算的计数加上当前窗口的计数，近似最近一个窗口内的计数
+type window struct {
+	size  time.Duration
+	start time.Time
+	cur   uint64
+	prev  uint64
+}
+
+//newWindow 初始化窗口大小为size的计数器
+func newWindow(size time.Duration) *window {
+	return &window{size: size}
+}
+
+//roll 按当前时间滚动窗口
+func (win *window) roll(now time.Time) {
+	elapsed := now.Sub(win.start)
+	switch {
+	case elapsed < win.size:
+		return
+	case elapsed < 2*win.size:
+		win.prev = win.cur
+	default:
+		win.prev = 0
+	}
+	win.cur = 0
+	win.start = now.Truncate(win.size)
+}
+
+//add 计数加一
+func (win *window) add(now time.Time) {
+	win.roll(now)
+	win.cur++
+}
+
+//count 最近一个窗口内的计数
+func (win *window) count(now time.Time) float64 {
+	win.roll(now)
+	rest := 1 - float64(now.Sub(win.start))/float64(win.size)
+	return float64(win.prev)*rest + float64(win.cur)
+}
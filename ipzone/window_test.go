@@ -0,0 +1,34 @@
+package ipzone
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ms := time.Millisecond
+	cases := []struct {
+		name string
+		adds []time.Duration //相对t0的计数时间
+		at   time.Duration
+		want float64
+	}{
+		{name: "empty", at: 500 * ms, want: 0},
+		{name: "current window", adds: []time.Duration{0, 100 * ms, 900 * ms}, at: 999 * ms, want: 3},
+		{name: "previous window weighted", adds: []time.Duration{0, 100 * ms, 200 * ms, 300 * ms}, at: 1250 * ms, want: 3},
+		{name: "previous and current", adds: []time.Duration{0, 500 * ms, 1100 * ms}, at: 1500 * ms, want: 2},
+		{name: "previous window at start", adds: []time.Duration{0, 500 * ms}, at: 1000 * ms, want: 2},
+		{name: "expired after two windows", adds: []time.Duration{0, 500 * ms}, at: 2000 * ms, want: 0},
+		{name: "gap longer than a window", adds: []time.Duration{0, 2500 * ms}, at: 2500 * ms, want: 1},
+	}
+	for _, c := range cases {
+		win := newWindow(time.Second)
+		for _, d := range c.adds {
+			win.add(t0.Add(d))
+		}
+		if got := win.count(t0.Add(c.at)); got != c.want {
+			t.Errorf("%s: count = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package ipzone
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//LoadZoneID 读取区域ID登记文件。每行格式为：区域名称;ID。
+//区域ID按名称登记，IP地址库增删区域或调整顺序、重新加载配置时，已有区域的ID保持不变；
+//IP地址库中已删除的区域仍保留在登记文件中，其ID不会分配给其他区域。文件不存在时从1开始分配
+func (ipdisp *IPDisp) LoadZoneID(conf string) (err error) {
+	ipdisp.zoneReg = make(map[string]int)
+	ipdisp.zoneMax = 1
+	var flines []string
+	flines, err = file2string(conf)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	ids := make(map[int]string)
+	for _, fline := range flines {
+		if len(fline) == 0 || fline[0] == '#' {
+			continue
+		}
+		i := strings.LastIndex(fline, ";")
+		if i < 0 {
+			continue
+		}
+		name := fline[:i]
+		var id int
+		if id, err = strconv.Atoi(fline[i+1:]); err != nil || id <= 0 {
+			return errors.New(conf + " not valid zone id: " + fline)
+		}
+		if other, ok := ids[id]; ok && other != name {
+			return errors.New(conf + " duplicate zone id: " + fline)
+		}
+		ids[id] = name
+		ipdisp.zoneReg[name] = id
+		if id >= ipdisp.zoneMax {
+			ipdisp.zoneMax = id + 1
+		}
+	}
+	return
+}
+
+//zoneid 返回区域的ID，没有登记的区域分配新的ID
+func (ipdisp *IPDisp) zoneid(name string) int {
+	if id, ok := ipdisp.zoneReg[name]; ok {
+		return id
+	}
+	id := ipdisp.zoneMax
+	ipdisp.zoneMax++
+	ipdisp.zoneReg[name] = id
+	ipdisp.zoneNew = true
+	return id
+}
+
+//SaveNewZone 有新登记的区域时保存区域ID登记文件。Init不写文件，由调用者在需要时保存。
+//保存失败时，本次仍可使用新分配的ID，下次加载时重新分配
+func (ipdisp *IPDisp) SaveNewZone(cfpath string) error {
+	if ipdisp.zoneNew == false {
+		return nil
+	}
+	return ipdisp.SaveZoneID(cfpath + "/zoneid")
+}
+
+//SaveZoneID 保存区域ID登记文件。先写入临时文件再改名，避免写入过程中文件不完整
+func (ipdisp *IPDisp) SaveZoneID(conf string) (err error) {
+	var names []string
+	for name := range ipdisp.zoneReg {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return ipdisp.zoneReg[names[i]] < ipdisp.zoneReg[names[j]]
+	})
+	var f *os.File
+	if f, err = os.CreateTemp(filepath.Dir(conf), ".zoneid"); err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	for _, name := range names {
+		w.WriteString(name + ";" + strconv.Itoa(ipdisp.zoneReg[name]) + "\n")
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	if err = os.Rename(f.Name(), conf); err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	ipdisp.zoneNew = false
+	return
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/xml"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dale-di/ipdispatch/ipzone"
+)
+
+const (
+	//manifestMax 播放列表的最大长度
+	manifestMax = 4 << 20
+	//manifestTimeout 回源获取播放列表的超时时间
+	manifestTimeout = 5 * time.Second
+)
+
+var manifestClient = &http.Client{Timeout: manifestTimeout}
+
+var (
+	//hlsURI HLS标签中的URI属性，如#EXT-X-KEY、#EXT-X-MAP、#EXT-X-MEDIA
+	hlsURI = regexp.MustCompile(`URI="([^"]*)"`)
+	//dashToken DASH中的BaseURL元素，以及可以带有BaseURL的元素的起始、结束标签
+	dashToken = regexp.MustCompile(`(<BaseURL[^>]*>)([^<]*)(</BaseURL>)|<(/?)(MPD|Period|AdaptationSet|Representation)\b[^>]*?(/?)>`)
+	//dashHead MPD起始标签之后、BaseURL之前的元素（按schema的顺序，BaseURL在ProgramInformation之后）
+	dashHead = regexp.MustCompile(`^(?s:\s*(?:<!--.*?-->|<ProgramInformation\b[^>]*/>|<ProgramInformation\b.*?</ProgramInformation>))*`)
+)
+
+//isManifest 是否为HLS或DASH的播放列表
+func isManifest(p string) bool {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".m3u8", ".mpd":
+		return true
+	}
+	return false
+}
+
+//serveManifest 从源站获取播放列表，将其中的相对地址改写为调度到的服务器上的绝对地址，
+//整个播放过程的分片都从同一台服务器获取
+func serveManifest(w http.ResponseWriter, r *http.Request, res *ipzone.Result) {
+	src := res.Origin() + r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		src += "?" + r.URL.RawQuery
+	}
+	resp, err := manifestClient.Get(src)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	if resp.StatusCode != http.StatusOK {
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, io.LimitReader(resp.Body, manifestMax))
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, manifestMax))
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	rw := &rewriter{res: res, scheme: reqScheme(r), clip: clientIP(r), base: &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath}}
+	if strings.ToLower(path.Ext(r.URL.Path)) == ".mpd" {
+		w.Write([]byte(rw.dash(string(body))))
+	} else {
+		w.Write([]byte(rw.hls(string(body))))
+	}
+}
+
+//rewriter 将播放列表中的地址改写为调度到的服务器上的绝对地址
+type rewriter struct {
+	res    *ipzone.Result
+	scheme string
+	clip   string   //客户端IP，分片地址的鉴权串绑定此IP
+	base   *url.URL //播放列表的路径，相对地址以此为基准
+}
+
+//abs 返回相对地址在调度到的服务器上的绝对地址，已经是绝对地址时不改写
+func (rw *rewriter) abs(ref string) string {
+	loc, _ := rw.resolve(rw.base, ref)
+	return loc
+}
+
+//resolve 以base为基准解析地址ref，返回改写后的地址和解析后的地址。
+//ref或base是其他服务器的绝对地址时不改写，解析失败时resolved为nil
+func (rw *rewriter) resolve(base *url.URL, ref string) (loc string, resolved *url.URL) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref, nil
+	}
+	resolved = base.ResolveReference(u)
+	if ref == "" || resolved.IsAbs() || resolved.Host != "" {
+		return ref, resolved
+	}
+	return rw.res.Location(rw.scheme, resolved.EscapedPath(), resolved.RawQuery, rw.clip), resolved
+}
+
+//hls 改写HLS播放列表：分片、子播放列表所在行，以及标签中的URI属性
+func (rw *rewriter) hls(body string) string {
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		text := strings.TrimRight(line, "\r")
+		switch {
+		case text == "":
+		case strings.HasPrefix(text, "#"):
+			lines[i] = hlsURI.ReplaceAllStringFunc(line, func(m string) string {
+				return `URI="` + rw.abs(hlsURI.FindStringSubmatch(m)[1]) + `"`
+			})
+		default:
+			lines[i] = rw.abs(strings.TrimSpace(text)) + line[len(text):]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+//dashLevel 带有BaseURL的元素：parent为上一级元素的BaseURL，base为本元素的BaseURL
+type dashLevel struct {
+	parent *url.URL
+	base   *url.URL
+	set    bool //本元素是否有BaseURL
+}
+
+//dash 改写DASH播放列表：相对地址的BaseURL以上一级元素的BaseURL为基准，改为绝对地址；
+//MPD下没有BaseURL时，按schema的顺序在ProgramInformation之后加入播放列表所在目录的BaseURL。
+//SegmentTemplate等相对地址以BaseURL为基准
+func (rw *rewriter) dash(body string) string {
+	var b strings.Builder
+	stack := []*dashLevel{{parent: rw.base, base: rw.base}}
+	last := 0
+	mpd := -1        //MPD起始标签之后的位置
+	mpdbase := false //MPD下是否有BaseURL
+	for _, m := range dashToken.FindAllStringSubmatchIndex(body, -1) {
+		b.WriteString(body[last:m[0]])
+		last = m[1]
+		top := stack[len(stack)-1]
+		switch {
+		case m[2] >= 0:
+			//BaseURL：同一元素的多个BaseURL互为备选，都以上一级元素的BaseURL为基准，第一个作为本元素的基准
+			ref := html.UnescapeString(strings.TrimSpace(body[m[4]:m[5]]))
+			loc, resolved := rw.resolve(top.parent, ref)
+			if top.set == false && resolved != nil {
+				top.base = resolved
+				top.set = true
+			}
+			if len(stack) == 2 {
+				mpdbase = true
+			}
+			b.WriteString(body[m[2]:m[3]])
+			if loc == ref {
+				b.WriteString(body[m[4]:m[5]])
+			} else {
+				b.WriteString(xmlEscape(loc))
+			}
+			b.WriteString(body[m[6]:m[7]])
+			continue
+		case m[8] < m[9]:
+			//结束标签
+			b.WriteString(body[m[0]:m[1]])
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+		b.WriteString(body[m[0]:m[1]])
+		if m[12] < m[13] {
+			//没有子元素
+			continue
+		}
+		if mpd < 0 && body[m[10]:m[11]] == "MPD" {
+			mpd = b.Len()
+		}
+		stack = append(stack, &dashLevel{parent: top.base, base: top.base})
+	}
+	b.WriteString(body[last:])
+	out := b.String()
+	if mpd < 0 || mpdbase {
+		return out
+	}
+	head := mpd + len(dashHead.FindString(out[mpd:]))
+	return out[:head] + "<BaseURL>" + xmlEscape(rw.abs("./")) + "</BaseURL>" + out[head:]
+}
+
+//xmlEscape 转义XML文本中的特殊字符
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
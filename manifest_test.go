@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+//testOrigin 测试用的源站内容，以路径为key
+var testOrigin = map[string]string{
+	"/live/master.m3u8": "#EXTM3U\n" +
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"a\",URI=\"audio/index.m3u8\"\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000\r\n" +
+		"low/index.m3u8\r\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000000\n" +
+		"http://cdn.x.com/live/high.m3u8\n",
+	"/live/low/index.m3u8": "#EXTM3U\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"../key.bin\"\n" +
+		"#EXT-X-MAP:URI=\"/init.mp4\"\n" +
+		"#EXTINF:4,\n" +
+		"seg%201.ts?x=1\n" +
+		"#EXT-X-ENDLIST\n",
+	"/vod/a.mpd": `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011">
+  <ProgramInformation><Title>t</Title></ProgramInformation>
+  <Period id="1">
+    <BaseURL>p1/</BaseURL>
+    <AdaptationSet>
+      <BaseURL>video/</BaseURL>
+      <Representation id="r1"><BaseURL>r1/</BaseURL><SegmentTemplate media="$Number$.m4s"/></Representation>
+      <Representation id="r2"/>
+    </AdaptationSet>
+  </Period>
+  <Period id="2">
+    <BaseURL>http://cdn.x.com/p2/</BaseURL>
+    <AdaptationSet><BaseURL>sub/</BaseURL></AdaptationSet>
+  </Period>
+</MPD>`,
+	"/vod/b.mpd": `<MPD><BaseURL>base/</BaseURL><BaseURL>alt/</BaseURL><Period><BaseURL>v/a&amp;b/</BaseURL></Period></MPD>`,
+}
+
+//startManifest 启动源站，加载manifest方式的配置，返回源站的请求计数
+func startManifest(t *testing.T) *int64 {
+	t.Helper()
+	var hits int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		body, ok := testOrigin[r.URL.Path]
+		if ok == false {
+			http.Error(w, "missing", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/test")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(origin.Close)
+	startActions(t, map[string]string{
+		"ipz":             "1.0.0.0/8;zone1|cp1\n",
+		"t.com/node.conf": "[conf]\nmode=manifest\norigin=" + origin.URL + "\n[a]\nserver=10.0.0.1 0 100\n",
+		"t.com/view.conf": "zone1|cp1;a\n",
+	})
+	return &hits
+}
+
+func TestManifest(t *testing.T) {
+	hits := startManifest(t)
+	handler := ipDisp()
+	cases := []struct {
+		name     string
+		path     string
+		status   int
+		location string
+		want     []string //响应中应有的内容
+		hit      bool     //是否回源
+	}{
+		{
+			name:   "hls master",
+			path:   "/live/master.m3u8",
+			status: http.StatusOK,
+			hit:    true,
+			want: []string{
+				`URI="http://10.0.0.1/live/audio/index.m3u8"`,
+				"#EXT-X-STREAM-INF:BANDWIDTH=800000\r\nhttp://10.0.0.1/live/low/index.m3u8\r\n",
+				"\nhttp://cdn.x.com/live/high.m3u8\n",
+			},
+		},
+		{
+			name:   "hls media",
+			path:   "/live/low/index.m3u8",
+			status: http.StatusOK,
+			hit:    true,
+			want: []string{
+				`#EXT-X-KEY:METHOD=AES-128,URI="http://10.0.0.1/live/key.bin"`,
+				`#EXT-X-MAP:URI="http://10.0.0.1/init.mp4"`,
+				"\nhttp://10.0.0.1/live/low/seg%201.ts?x=1\n",
+				"#EXT-X-ENDLIST",
+			},
+		},
+		{
+			name:   "dash nested BaseURL",
+			path:   "/vod/a.mpd",
+			status: http.StatusOK,
+			hit:    true,
+			want: []string{
+				"</ProgramInformation><BaseURL>http://10.0.0.1/vod/</BaseURL>\n  <Period id=\"1\">",
+				"<BaseURL>http://10.0.0.1/vod/p1/</BaseURL>",
+				"<BaseURL>http://10.0.0.1/vod/p1/video/</BaseURL>",
+				"<BaseURL>http://10.0.0.1/vod/p1/video/r1/</BaseURL>",
+				"<BaseURL>http://cdn.x.com/p2/</BaseURL>",
+				"<BaseURL>sub/</BaseURL>",
+			},
+		},
+		{
+			name:   "dash MPD BaseURL",
+			path:   "/vod/b.mpd",
+			status: http.StatusOK,
+			hit:    true,
+			want: []string{
+				"<MPD><BaseURL>http://10.0.0.1/vod/base/</BaseURL><BaseURL>http://10.0.0.1/vod/alt/</BaseURL>",
+				"<BaseURL>http://10.0.0.1/vod/base/v/a&amp;b/</BaseURL>",
+			},
+		},
+		{
+			name:   "origin error",
+			path:   "/live/missing.m3u8",
+			status: http.StatusNotFound,
+			hit:    true,
+			want:   []string{"missing"},
+		},
+		{
+			name:     "not a manifest",
+			path:     "/live/low/seg%201.ts?x=1",
+			status:   http.StatusFound,
+			location: "http://10.0.0.1/live/low/seg%201.ts?x=1",
+		},
+	}
+	for _, c := range cases {
+		before := atomic.LoadInt64(hits)
+		r := httptest.NewRequest("GET", "http://t.com"+c.path, nil)
+		r.RemoteAddr = "1.2.3.4:5000"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s: status = %d, want %d", c.name, w.Code, c.status)
+			continue
+		}
+		if loc := w.Header().Get("Location"); loc != c.location {
+			t.Errorf("%s: location = %q, want %q", c.name, loc, c.location)
+		}
+		if hit := atomic.LoadInt64(hits) > before; hit != c.hit {
+			t.Errorf("%s: origin hit = %v, want %v", c.name, hit, c.hit)
+		}
+		body := w.Body.String()
+		for _, s := range c.want {
+			if strings.Contains(body, s) == false {
+				t.Errorf("%s: %q not in\n%s", c.name, s, body)
+			}
+		}
+		if c.hit && c.status == http.StatusOK && w.Header().Get("Content-Type") != "application/test" {
+			t.Errorf("%s: content type = %q", c.name, w.Header().Get("Content-Type"))
+		}
+	}
+}
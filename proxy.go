@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/dale-di/ipdispatch/ipzone"
+)
+
+const (
+	//proxyRetry 连接失败时最多重试的备选服务器数
+	proxyRetry = 3
+	//proxyDialTimeout 连接服务器的超时时间
+	proxyDialTimeout = 3 * time.Second
+)
+
+var proxyTransport *http.Transport
+
+//initProxy 初始化代理方式使用的连接池，timeout为等待服务器响应头的超时时间
+func initProxy(timeout time.Duration) {
+	dialer := &net.Dialer{Timeout: proxyDialTimeout, KeepAlive: 30 * time.Second}
+	proxyTransport = &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: timeout,
+		TLSHandshakeTimeout:   proxyDialTimeout,
+	}
+}
+
+//proxyTarget 代理的目标服务器
+type proxyTarget struct {
+	url  *url.URL //与跳转地址相同
+	host string   //请求的Host，调度到第三方CDN时为CDN的域名，否则与客户端请求相同
+}
+
+//retryTransport 依次向目标服务器发送请求，连接失败时重试下一台。
+//请求带有body时，body可能已被读取，不再重试
+type retryTransport struct {
+	targets []proxyTarget
+}
+
+//RoundTrip 实现http.RoundTripper
+func (rt *retryTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	for i, t := range rt.targets {
+		out := req.Clone(req.Context())
+		*out.URL = *t.url
+		out.Host = t.host
+		if resp, err = proxyTransport.RoundTrip(out); err == nil {
+			return
+		}
+		if dialFailed(err) == false || (req.Body != nil && req.Body != http.NoBody) || i == len(rt.targets)-1 {
+			return
+		}
+	}
+	return
+}
+
+//dialFailed 是否为连接服务器失败
+func dialFailed(err error) bool {
+	var operr *net.OpError
+	if errors.As(err, &operr) && operr.Op == "dial" {
+		return true
+	}
+	return false
+}
+
+//serveProxy 将请求代理到调度到的服务器，连接失败时依次重试备选服务器。响应以流的方式返回给客户端，
+//X-Real-IP头设置为客户端IP
+func serveProxy(w http.ResponseWriter, r *http.Request, clip string, rsv *resolution) {
+	scheme := reqScheme(r)
+	rt := &retryTransport{}
+	for _, res := range append([]*ipzone.Result{rsv.res}, rsv.alts...) {
+		//请求由调度服务发往服务器，服务器看到的是调度服务的地址，默认鉴权串不绑定客户端IP
+		u, err := url.Parse(res.Location(scheme, r.URL.EscapedPath(), r.URL.RawQuery, res.ProxyClip(clip)))
+		if err != nil || u.Host == "" {
+			continue
+		}
+		t := proxyTarget{url: u, host: r.Host}
+		if res.CDNHost() != "" {
+			t.host = u.Host
+		}
+		rt.targets = append(rt.targets, t)
+	}
+	if len(rt.targets) == 0 {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	//代理的响应可能较大，不受调度服务写超时的限制
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	rp := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = rt.targets[0].url.Scheme
+			req.URL.Host = rt.targets[0].url.Host
+			req.Header.Set("X-Real-IP", clip)
+		},
+		Transport:     rt,
+		FlushInterval: 100 * time.Millisecond,
+	}
+	rp.ServeHTTP(w, r)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dale-di/ipdispatch/urlsign"
+)
+
+//deadPort 返回一个没有监听的本地端口
+func deadPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return port
+}
+
+func TestProxyRetry(t *testing.T) {
+	keys := urlsign.Keys{}
+	key, _ := urlsign.ParseKey("k1:secret")
+	keys.Add(key)
+	//边缘服务器：按X-Real-IP或不绑定IP校验鉴权串
+	edge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clip := ""
+		if r.Host == "p.com" {
+			clip = r.Header.Get("X-Real-IP")
+		}
+		if err := keys.VerifyURL(r.URL, "", clip, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("edge " + r.Host + " " + r.Header.Get("X-Real-IP")))
+	}))
+	t.Cleanup(edge.Close)
+	port := strconv.Itoa(edge.Listener.Addr().(*net.TCPAddr).Port)
+	dead := strconv.Itoa(deadPort(t))
+	//节点a的服务器拒绝连接，重试overflow2node节点b的服务器
+	node := "[a]\noverflow2node=b\nserver=127.0.0.1 0 100 up port=" + dead + "\n[b]\nserver=127.0.0.1 1 100 up port=" + port + "\n"
+	startActions(t, map[string]string{
+		"ipz":             "1.0.0.0/8;zone1|cp1\n",
+		"p.com/node.conf": "[conf]\nmode=proxy\ntokenkey=k1:secret\ntokenproxyip=yes\n" + node,
+		"p.com/view.conf": "zone1|cp1;a\n",
+		"q.com/node.conf": "[conf]\nmode=proxy\ntokenkey=k1:secret\n" + node,
+		"q.com/view.conf": "zone1|cp1;a\n",
+	})
+	initProxy(time.Second)
+	handler := ipDisp()
+	cases := []struct {
+		host string
+		want string
+	}{
+		{host: "p.com", want: "edge p.com 1.1.1.1"},
+		{host: "q.com", want: "edge q.com 1.1.1.1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "http://"+c.host+"/a.ts", nil)
+		r.Header.Set("X-Addr", "1.1.1.1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != c.want {
+			t.Errorf("%s: got %d %q, want %q", c.host, w.Code, w.Body.String(), c.want)
+		}
+	}
+
+	//绑定客户端IP的鉴权串不能以调度服务的地址通过校验
+	res, err := ipdisp.Query("1.1.1.1", "p.com", "/a.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(res.Location("http", "/a.ts", "", res.ProxyClip("1.1.1.1")))
+	if keys.VerifyURL(u, "", "", time.Now()) == nil || keys.VerifyURL(u, "", "1.1.1.1", time.Now()) != nil {
+		t.Errorf("token in %s not bound to client ip", u)
+	}
+}
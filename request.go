@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+//trustnets 可信代理的网段，只有来自这些地址的请求才使用X-Forwarded-Proto
+var trustnets []*net.IPNet
+
+//parseTrustProxy 解析以逗号分隔的可信代理网段
+func parseTrustProxy(cidrs string) (err error) {
+	for _, cidr := range strings.Split(cidrs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		var ipnet *net.IPNet
+		if _, ipnet, err = net.ParseCIDR(cidr); err != nil {
+			return
+		}
+		trustnets = append(trustnets, ipnet)
+	}
+	return
+}
+
+//trusted 请求是否来自可信代理
+func trusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range trustnets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//clientIP 返回调度使用的客户端IP：设置了X-Addr头时使用X-Addr，否则为连接的对端地址（不含端口）
+func clientIP(r *http.Request) string {
+	if addr := r.Header.Get("X-Addr"); addr != "" {
+		return addr
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//reqScheme 返回客户端请求的协议。TLS请求为https；来自可信代理的请求，使用X-Forwarded-Proto
+func reqScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto != "" && trusted(r) {
+		if proto == "https" {
+			return "https"
+		}
+	}
+	return "http"
+}
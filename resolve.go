@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/dale-di/ipdispatch/ipzone"
+)
+
+//resolution 调度协程返回的调度结果和备选列表
+type resolution struct {
+	res     *ipzone.Result
+	alts    []*ipzone.Result
+	err     error
+	failure *ipzone.Failure //域名配置的调度失败处理方式
+}
+
+//resolveServer 调度到的服务器
+type resolveServer struct {
+	Node string `json:"node"`
+	IP   string `json:"ip,omitempty"`
+	ID   int    `json:"id"`
+	URL  string `json:"url"`
+}
+
+//resolveResult /ipd/resolve返回的调度结果
+type resolveResult struct {
+	Host       string          `json:"host"`
+	ClientIP   string          `json:"client_ip"`
+	Zone       string          `json:"zone"`
+	Node       string          `json:"node"`
+	TTL        int             `json:"ttl"`
+	Server     resolveServer   `json:"server"`
+	Alternates []resolveServer `json:"alternates"`
+}
+
+//resolve 以JSON返回调度结果，供SDK和播放器自行跳转和故障切换。
+//客户端IP与跳转相同，哈希调度使用path参数中的路径
+func resolve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", SVer)
+	queryparam := r.URL.Query()
+	clip := clientIP(r)
+	host := queryparam.Get("host")
+	if host == "" {
+		host = r.Host
+	}
+	//path参数为请求的地址（可以带查询字符串），跳转地址使用转义后的路径，哈希使用解码后的路径
+	ref, err := url.Parse(queryparam.Get("path"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid path"})
+		return
+	}
+	if ref.Path == "" {
+		ref.Path = "/"
+	}
+	path, query := ref.EscapedPath(), ref.RawQuery
+	if adm.acquire() == false {
+		w.Header().Set("Retry-After", "1")
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "too many requests"})
+		return
+	}
+	defer adm.release()
+	actionLock.Lock()
+	ipdActionCH <- ipdAction{action: "resolve", param: map[string]string{"clip": clip, "host": host, "path": ref.Path, "n": queryparam.Get("n")}}
+	ipdaction := <-ipdResultCH
+	actionLock.Unlock()
+	rsv := ipdaction.result.(*resolution)
+	if rsv.err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": rsv.err.Error()})
+		return
+	}
+	adm.remember(host, clip, rsv.res)
+	scheme := reqScheme(r)
+	rr := resolveResult{Host: host, ClientIP: clip, Zone: rsv.res.Zone, Node: rsv.res.Node, TTL: rsv.res.TTL()}
+	rr.Server = newResolveServer(rsv.res, scheme, path, query, clip)
+	rr.Alternates = make([]resolveServer, 0, len(rsv.alts))
+	for _, alt := range rsv.alts {
+		rr.Alternates = append(rr.Alternates, newResolveServer(alt, scheme, path, query, clip))
+	}
+	writeJSON(w, http.StatusOK, rr)
+}
+
+//newResolveServer 根据调度结果生成服务器信息，url与跳转地址相同
+func newResolveServer(res *ipzone.Result, scheme string, path string, query string, clip string) resolveServer {
+	return resolveServer{Node: res.Node, IP: res.IP, ID: res.ServerID(), URL: res.Location(scheme, path, query, clip)}
+}
+
+//writeJSON 以JSON格式输出响应
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
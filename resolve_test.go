@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	startActions(t, testConf)
+	handler := ipDisp()
+	get := func(query url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/ipd/resolve?"+query.Encode(), nil)
+		r.Header.Set("X-Addr", "1.2.3.4")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get(url.Values{"host": {"T.com"}, "path": {"/v/a%20b.ts?x=1"}, "n": {"2"}})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+	var rr resolveResult
+	if err := json.Unmarshal(w.Body.Bytes(), &rr); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Host != "T.com" || rr.ClientIP != "1.2.3.4" || rr.Zone != "zone1|cp1" || rr.Node != "a" || rr.TTL != 30 {
+		t.Errorf("result: %+v", rr)
+	}
+	//主服务器和备选服务器是节点a的两台服务器
+	other := map[string]string{"10.0.0.1": "10.0.0.2", "10.0.0.2": "10.0.0.1"}
+	if rr.Server.Node != "a" || other[rr.Server.IP] == "" || rr.Server.URL != "http://"+rr.Server.IP+"/v/a%20b.ts?x=1" {
+		t.Errorf("server: %+v", rr.Server)
+	}
+	if len(rr.Alternates) != 1 || rr.Alternates[0].IP != other[rr.Server.IP] || rr.Alternates[0].ID == rr.Server.ID ||
+		rr.Alternates[0].URL != "http://"+other[rr.Server.IP]+"/v/a%20b.ts?x=1" {
+		t.Errorf("alternates: %+v", rr.Alternates)
+	}
+
+	cases := []struct {
+		name   string
+		query  url.Values
+		status int
+		error  string
+	}{
+		{name: "unknown host", query: url.Values{"host": {"nohost.com"}}, status: http.StatusNotFound, error: "Not found nohost.com"},
+		{name: "invalid path", query: url.Values{"host": {"t.com"}, "path": {"/a%zz"}}, status: http.StatusBadRequest, error: "invalid path"},
+	}
+	for _, c := range cases {
+		w := get(c.query)
+		var body map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if w.Code != c.status || body["error"] != c.error {
+			t.Errorf("%s: got %d %q, want %d %q", c.name, w.Code, body["error"], c.status, c.error)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dale-di/ipdispatch/ipzone"
+)
+
+//certStore 各域名的证书，按SNI选择。证书为配置目录中域名目录下的cert.pem和key.pem，
+//配置目录下的cert.pem和key.pem为没有匹配的证书时使用的默认证书
+type certStore struct {
+	mutex    sync.RWMutex
+	certs    map[string]*tls.Certificate
+	fallback *tls.Certificate //默认证书，没有时为nil
+}
+
+var certs = &certStore{certs: make(map[string]*tls.Certificate)}
+
+//load 加载配置目录中所有域名的证书。证书以域名目录名、node.conf中的别名和证书中的域名（SAN）登记。
+//有证书加载失败时返回错误，继续使用原来的证书
+func (cs *certStore) load(cfpath string, ipd *ipzone.IPDisp) (err error) {
+	var dirs []os.FileInfo
+	if dirs, err = ioutil.ReadDir(cfpath); err != nil {
+		return
+	}
+	var fallback *tls.Certificate
+	if fallback, err = loadCert(cfpath); err != nil {
+		return
+	}
+	certmap := make(map[string]*tls.Certificate)
+	for _, dir := range dirs {
+		if dir.IsDir() == false {
+			continue
+		}
+		cert, lerr := loadCert(filepath.Join(cfpath, dir.Name()))
+		if lerr != nil {
+			return errors.New(dir.Name() + ": " + lerr.Error())
+		}
+		if cert == nil {
+			continue
+		}
+		certmap[strings.ToLower(dir.Name())] = cert
+		for _, name := range ipd.Aliases(dir.Name()) {
+			certmap[name] = cert
+		}
+		for _, name := range cert.Leaf.DNSNames {
+			if _, ok := certmap[strings.ToLower(name)]; ok == false {
+				certmap[strings.ToLower(name)] = cert
+			}
+		}
+	}
+	cs.mutex.Lock()
+	cs.certs = certmap
+	cs.fallback = fallback
+	cs.mutex.Unlock()
+	return
+}
+
+//loadCert 加载目录下的cert.pem和key.pem，没有cert.pem时返回nil
+func loadCert(dir string) (cert *tls.Certificate, err error) {
+	certfile := filepath.Join(dir, "cert.pem")
+	if _, serr := os.Stat(certfile); serr != nil {
+		return nil, nil
+	}
+	c, err := tls.LoadX509KeyPair(certfile, filepath.Join(dir, "key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+//get 按SNI返回证书，没有时依次查找通配符证书（*.example.com）和默认证书
+func (cs *certStore) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	if cert, ok := cs.certs[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		if cert, ok := cs.certs["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	if cs.fallback != nil {
+		return cs.fallback, nil
+	}
+	return nil, errors.New("no certificate for " + name)
+}
+
+//tlsConfig 返回HTTPS服务的TLS配置，证书按SNI动态选择，重新加载后立即生效
+func tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.get,
+		NextProtos:     []string{"http/1.1"},
+	}
+}
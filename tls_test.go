@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dale-di/ipdispatch/ipzone"
+)
+
+//writeCert 在dir中生成自签名的cert.pem和key.pem，证书的CommonName为cn
+func writeCert(t *testing.T, dir string, cn string, names ...string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	conf := map[string]string{
+		"ipz":             "1.0.0.0/8;zone1|cp1\n",
+		"t.com/node.conf": "[conf]\nalias=www.t.org\n[a]\nserver=10.0.0.1 0 100\n",
+		"t.com/view.conf": "zone1|cp1;a\n",
+		"w.com/node.conf": "[a]\nserver=10.0.0.2 0 100\n",
+		"w.com/view.conf": "zone1|cp1;a\n",
+	}
+	for name, content := range conf {
+		fname := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCert(t, filepath.Join(dir, "t.com"), "t", "t.com", "img.t.com")
+	writeCert(t, filepath.Join(dir, "w.com"), "w", "*.w.com")
+	ins := ipzone.New()
+	if err := ins.Init(dir); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		want string //证书的CommonName，为空时没有证书
+	}{
+		{name: "t.com", want: "t"},
+		{name: "T.Com.", want: "t"},
+		{name: "img.t.com", want: "t"},
+		{name: "www.t.org", want: "t"},
+		{name: "a.w.com", want: "w"},
+		{name: "a.b.w.com", want: "default"},
+		{name: "x.com", want: "default"},
+		{name: "", want: "default"},
+	}
+	check := func(cs *certStore, fallback bool) {
+		for _, c := range cases {
+			want := c.want
+			if want == "default" && fallback == false {
+				want = ""
+			}
+			cert, err := cs.get(&tls.ClientHelloInfo{ServerName: c.name})
+			switch {
+			case want == "" && err == nil:
+				t.Errorf("%q: got %s, want error", c.name, cert.Leaf.Subject.CommonName)
+			case want != "" && err != nil:
+				t.Errorf("%q: %v", c.name, err)
+			case want != "" && cert.Leaf.Subject.CommonName != want:
+				t.Errorf("%q: got %s, want %s", c.name, cert.Leaf.Subject.CommonName, want)
+			}
+		}
+	}
+
+	cs := &certStore{}
+	if err := cs.load(dir, ins); err != nil {
+		t.Fatal(err)
+	}
+	check(cs, false)
+	//配置目录下的证书作为默认证书，重新加载后生效
+	writeCert(t, dir, "default", "default.local")
+	if err := cs.load(dir, ins); err != nil {
+		t.Fatal(err)
+	}
+	check(cs, true)
+}
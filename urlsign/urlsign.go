@@ -0,0 +1,106 @@
+//Package urlsign 生成和校验调度跳转地址中的鉴权串。
+//鉴权串格式为：过期时间-密钥ID-签名，签名为HMAC-SHA256(密钥, 路径|客户端IP|过期时间|密钥ID)，以base64url编码。
+//边缘服务器导入此包，用同一组密钥校验请求，拒绝未经过调度的请求。密钥ID用于轮换密钥：
+//调度服务切换到新密钥前，边缘服务器同时持有新旧密钥
+package urlsign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//DefaultParam 鉴权串默认的参数名
+const DefaultParam = "ipdtoken"
+
+var (
+	//ErrMissing 没有鉴权串
+	ErrMissing = errors.New("urlsign: missing token")
+	//ErrMalformed 鉴权串格式错误
+	ErrMalformed = errors.New("urlsign: malformed token")
+	//ErrExpired 鉴权串已过期
+	ErrExpired = errors.New("urlsign: token expired")
+	//ErrUnknownKey 没有鉴权串使用的密钥
+	ErrUnknownKey = errors.New("urlsign: unknown key id")
+	//ErrSignature 签名不匹配
+	ErrSignature = errors.New("urlsign: signature mismatch")
+)
+
+//Key 签名密钥
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+//ParseKey 解析id:secret格式的密钥，id中不能有“-”
+func ParseKey(s string) (key Key, err error) {
+	i := strings.Index(s, ":")
+	if i <= 0 || i == len(s)-1 || strings.Contains(s[:i], "-") {
+		err = errors.New("urlsign: not valid key: " + s)
+		return
+	}
+	key.ID = s[:i]
+	key.Secret = []byte(s[i+1:])
+	return
+}
+
+//Sign 生成鉴权串。clientip为空时不绑定客户端IP
+func Sign(key Key, path string, clientip string, exp time.Time) string {
+	e := strconv.FormatInt(exp.Unix(), 10)
+	return e + "-" + key.ID + "-" + mac(key.Secret, path, clientip, e, key.ID)
+}
+
+//Keys 校验使用的密钥，以密钥ID为key
+type Keys map[string][]byte
+
+//Add 加入密钥
+func (ks Keys) Add(key Key) {
+	ks[key.ID] = key.Secret
+}
+
+//Verify 校验鉴权串。clientip需与签名时相同，签名时不绑定客户端IP则为空
+func (ks Keys) Verify(token string, path string, clientip string, now time.Time) error {
+	items := strings.SplitN(token, "-", 3)
+	if len(items) != 3 {
+		return ErrMalformed
+	}
+	exp, err := strconv.ParseInt(items[0], 10, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+	secret, ok := ks[items[1]]
+	if ok == false {
+		return ErrUnknownKey
+	}
+	if hmac.Equal([]byte(items[2]), []byte(mac(secret, path, clientip, items[0], items[1]))) == false {
+		return ErrSignature
+	}
+	if now.Unix() > exp {
+		return ErrExpired
+	}
+	return nil
+}
+
+//VerifyURL 校验请求地址中param参数的鉴权串，param为空时使用DefaultParam
+func (ks Keys) VerifyURL(u *url.URL, param string, clientip string, now time.Time) error {
+	if param == "" {
+		param = DefaultParam
+	}
+	token := u.Query().Get(param)
+	if token == "" {
+		return ErrMissing
+	}
+	return ks.Verify(token, u.Path, clientip, now)
+}
+
+//mac 计算签名
+func mac(secret []byte, path string, clientip string, exp string, kid string) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(path + "|" + clientip + "|" + exp + "|" + kid))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,119 @@
+package urlsign
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	k1 := Key{ID: "k1", Secret: []byte("secret1")}
+	k2 := Key{ID: "k2", Secret: []byte("secret2")}
+	token := Sign(k1, "/a/b.mp4", "1.2.3.4", now.Add(time.Minute))
+	cases := []struct {
+		name  string
+		keys  []Key
+		token string
+		path  string
+		ip    string
+		now   time.Time
+		want  error
+	}{
+		{name: "valid", keys: []Key{k1}, token: token, path: "/a/b.mp4", ip: "1.2.3.4", now: now},
+		{name: "at expiry", keys: []Key{k1}, token: token, path: "/a/b.mp4", ip: "1.2.3.4", now: now.Add(time.Minute)},
+		{name: "expired", keys: []Key{k1}, token: token, path: "/a/b.mp4", ip: "1.2.3.4", now: now.Add(time.Minute + time.Second), want: ErrExpired},
+		{name: "other path", keys: []Key{k1}, token: token, path: "/a/c.mp4", ip: "1.2.3.4", now: now, want: ErrSignature},
+		{name: "other ip", keys: []Key{k1}, token: token, path: "/a/b.mp4", ip: "1.2.3.5", now: now, want: ErrSignature},
+		{name: "unbound verified with ip", keys: []Key{k1}, token: Sign(k1, "/a/b.mp4", "", now), path: "/a/b.mp4", ip: "1.2.3.4", now: now, want: ErrSignature},
+		{name: "unbound", keys: []Key{k1}, token: Sign(k1, "/a/b.mp4", "", now), path: "/a/b.mp4", now: now},
+		{name: "rotation keeps old key", keys: []Key{k1, k2}, token: token, path: "/a/b.mp4", ip: "1.2.3.4", now: now},
+		{name: "rotation new key", keys: []Key{k1, k2}, token: Sign(k2, "/a/b.mp4", "1.2.3.4", now), path: "/a/b.mp4", ip: "1.2.3.4", now: now},
+		{name: "old key removed", keys: []Key{k2}, token: token, path: "/a/b.mp4", ip: "1.2.3.4", now: now, want: ErrUnknownKey},
+		{name: "same id other secret", keys: []Key{{ID: "k1", Secret: []byte("other")}}, token: token, path: "/a/b.mp4", ip: "1.2.3.4", now: now, want: ErrSignature},
+		{name: "tampered expiry", keys: []Key{k1}, token: "1800000000" + token[10:], path: "/a/b.mp4", ip: "1.2.3.4", now: now, want: ErrSignature},
+		{name: "tampered key id", keys: []Key{k1, k2}, token: token[:11] + "k2" + token[13:], path: "/a/b.mp4", ip: "1.2.3.4", now: now, want: ErrSignature},
+		{name: "tampered signature", keys: []Key{k1}, token: token[:len(token)-1] + "x", path: "/a/b.mp4", ip: "1.2.3.4", now: now, want: ErrSignature},
+		{name: "malformed", keys: []Key{k1}, token: "abc", path: "/a/b.mp4", now: now, want: ErrMalformed},
+		{name: "malformed expiry", keys: []Key{k1}, token: "x-k1-abc", path: "/a/b.mp4", now: now, want: ErrMalformed},
+	}
+	for _, c := range cases {
+		ks := Keys{}
+		for _, k := range c.keys {
+			ks.Add(k)
+		}
+		if err := ks.Verify(c.token, c.path, c.ip, c.now); err != c.want {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestVerifyURL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	k := Key{ID: "k1", Secret: []byte("secret1")}
+	ks := Keys{}
+	ks.Add(k)
+	token := Sign(k, "/a b/c.m3u8", "1.2.3.4", now.Add(time.Minute))
+	cases := []struct {
+		name  string
+		url   string
+		param string
+		want  error
+	}{
+		{name: "default param", url: "http://e.com/a%20b/c.m3u8?x=1&ipdtoken=" + token},
+		{name: "custom param", url: "http://e.com/a%20b/c.m3u8?t=" + token, param: "t"},
+		{name: "missing", url: "http://e.com/a%20b/c.m3u8?x=1", want: ErrMissing},
+		{name: "other path", url: "http://e.com/a%20b/d.m3u8?ipdtoken=" + token, want: ErrSignature},
+	}
+	for _, c := range cases {
+		u, err := url.Parse(c.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ks.VerifyURL(u, c.param, "1.2.3.4", now); err != c.want {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	cases := []struct {
+		in   string
+		id   string
+		fail bool
+	}{
+		{in: "k1:secret", id: "k1"},
+		{in: "k1:a:b", id: "k1"},
+		{in: ":secret", fail: true},
+		{in: "k1:", fail: true},
+		{in: "k-1:secret", fail: true},
+		{in: "secret", fail: true},
+	}
+	for _, c := range cases {
+		key, err := ParseKey(c.in)
+		if (err != nil) != c.fail {
+			t.Errorf("%s: err = %v", c.in, err)
+			continue
+		}
+		if key.ID != c.id {
+			t.Errorf("%s: id = %s, want %s", c.in, key.ID, c.id)
+		}
+	}
+}
+
+func TestSignVector(t *testing.T) {
+	//签名为HMAC-SHA256("secret1", "/a/b.mp4|客户端IP|1700000060|k1")，以base64url编码，不带填充
+	cases := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "1.2.3.4", want: "1700000060-k1-IThnI5wGHqBu1QwquVK9eI-McpRdT5_UICfhqI2zgsI"},
+		{ip: "", want: "1700000060-k1-Ggixrl2XPTCCJQdLwJ53MNt2dYtEby75pQCxptioql8"},
+	}
+	k := Key{ID: "k1", Secret: []byte("secret1")}
+	for _, c := range cases {
+		if got := Sign(k, "/a/b.mp4", c.ip, time.Unix(1700000060, 0)); got != c.want {
+			t.Errorf("Sign = %s, want %s", got, c.want)
+		}
+	}
+}